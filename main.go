@@ -7,8 +7,8 @@ import (
 	"github.com/practice/virtual-kubelet-practice/pkg/remote"
 	"github.com/sirupsen/logrus"
 	cli "github.com/virtual-kubelet/node-cli"
-	//"github.com/virtual-kubelet/node-cli/opts"
 	logruscli "github.com/virtual-kubelet/node-cli/logrus"
+	"github.com/virtual-kubelet/node-cli/opts"
 	"github.com/virtual-kubelet/node-cli/provider"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	logruslogger "github.com/virtual-kubelet/virtual-kubelet/log/logrus"
@@ -31,17 +31,45 @@ func main() {
 
 	log.L = logruslogger.FromLogrus(logrus.NewEntry(logger))
 	logConfig := &logruscli.Config{LogLevel: "info"}
+	providerFlags := &common.ProviderFlags{}
+
+	// 启动参数，解析命令行后provider可以获取kubeconfig等配置
+	o, err := opts.FromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	// podServer 命令行解析后读取，为nil时由node-cli启动kubelet API server
+	var podServer *common.PodServerConfig
 
 	node, err := cli.New(ctx,
+		cli.WithBaseOpts(o),
 		cli.WithProvider(providerName, func(cfg provider.InitConfig) (provider.Provider, error) {
-			return providers.NewCriProvider(common.SetupConfig(cfg), remoteCRI), nil
+			config, err := common.SetupConfig(cfg, o, providerFlags)
+			if err != nil {
+				return nil, err
+			}
+			p := providers.NewCriProvider(config, remoteCRI)
+			// 自己启动kubelet API server，注册node-cli没有的attach与portForward路由
+			if podServer != nil {
+				handler := p.PodHandler(podServer.StreamIdleTimeout, podServer.StreamCreationTimeout)
+				if err := common.ServePods(ctx, podServer, handler); err != nil {
+					return nil, err
+				}
+			}
+			return p, nil
 		}),
 		cli.WithKubernetesNodeVersion(k8sVersion),
 		// Adds flags and parsing for using logrus as the configured logger
 		cli.WithPersistentFlags(logConfig.FlagSet()),
+		cli.WithPersistentFlags(providerFlags.FlagSet()),
 		cli.WithPersistentPreRunCallback(func() error {
 			return logruscli.Configure(logConfig, logger)
 		}),
+		cli.WithPersistentPreRunCallback(func() error {
+			podServer = common.TakeOverPodServer(o)
+			return nil
+		}),
 	)
 
 	if err != nil {
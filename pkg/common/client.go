@@ -0,0 +1,36 @@
+package common
+
+import (
+	"os"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewKubeClient 创建k8s客户端，与node-cli的规则一致：
+// kubeconfig文件存在时使用kubeconfig，否则使用in-cluster配置
+func NewKubeClient(configPath string, qps, burst int32) (kubernetes.Interface, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	if _, statErr := os.Stat(configPath); configPath != "" && statErr == nil {
+		config, err = clientcmd.BuildConfigFromFlags("", configPath)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if qps != 0 {
+		config.QPS = float32(qps)
+	}
+	if burst != 0 {
+		config.Burst = int(burst)
+	}
+	if masterURI := os.Getenv("MASTER_URI"); masterURI != "" {
+		config.Host = masterURI
+	}
+	return kubernetes.NewForConfig(config)
+}
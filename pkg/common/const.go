@@ -1,6 +1,11 @@
 package common
 
-import "github.com/virtual-kubelet/node-cli/provider"
+import (
+	"github.com/virtual-kubelet/node-cli/manager"
+	"github.com/virtual-kubelet/node-cli/opts"
+	"github.com/virtual-kubelet/node-cli/provider"
+	"k8s.io/client-go/kubernetes"
+)
 
 // ProviderConfig provider 配置文件
 type ProviderConfig struct {
@@ -18,14 +23,33 @@ type ProviderConfig struct {
 	ResourceMemory string
 	// MaxPod 最大pod数
 	MaxPod string
+	// ResourceManager 获取configMap、secret等k8s资源
+	ResourceManager *manager.ResourceManager
+	// KubeClient k8s客户端，用于监听configMap、secret的变化
+	KubeClient kubernetes.Interface
+	// ClusterDNS 集群dns服务地址
+	ClusterDNS []string
+	// ClusterDomain 集群域名，例如cluster.local
+	ClusterDomain string
+	// AdoptForeignSandboxes 是否接管没有本节点标签的sandbox
+	AdoptForeignSandboxes bool
 }
 
-// SetupConfig 设置配置文件
-func SetupConfig(cfg provider.InitConfig) *ProviderConfig {
-	return &ProviderConfig{
-		NodeName:           cfg.NodeName,
-		OperatingSystem:    cfg.OperatingSystem,
-		DaemonEndpointPort: cfg.DaemonPort,
-		InternalIp:         cfg.InternalIP,
+// SetupConfig 设置配置文件，o为node-cli解析后的启动参数，flags为provider自己的启动参数
+func SetupConfig(cfg provider.InitConfig, o *opts.Opts, flags *ProviderFlags) (*ProviderConfig, error) {
+	client, err := NewKubeClient(o.KubeConfigPath, o.KubeAPIQPS, o.KubeAPIBurst)
+	if err != nil {
+		return nil, err
 	}
+	return &ProviderConfig{
+		NodeName:              cfg.NodeName,
+		OperatingSystem:       cfg.OperatingSystem,
+		DaemonEndpointPort:    cfg.DaemonPort,
+		InternalIp:            cfg.InternalIP,
+		ResourceManager:       cfg.ResourceManager,
+		KubeClient:            client,
+		ClusterDNS:            flags.ClusterDNS,
+		ClusterDomain:         cfg.KubeClusterDomain,
+		AdoptForeignSandboxes: flags.AdoptForeignSandboxes,
+	}, nil
 }
@@ -0,0 +1,21 @@
+package common
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// ProviderFlags provider自己的启动参数，node-cli中没有的配置
+type ProviderFlags struct {
+	// ClusterDNS 集群dns服务地址，dnsPolicy为ClusterFirst的pod使用
+	ClusterDNS []string
+	// AdoptForeignSandboxes 是否接管没有本节点标签的sandbox，只接管调度到本节点的pod
+	AdoptForeignSandboxes bool
+}
+
+// FlagSet 生成命令行参数
+func (f *ProviderFlags) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("provider", pflag.ContinueOnError)
+	flags.StringSliceVar(&f.ClusterDNS, "cluster-dns", f.ClusterDNS, "comma-separated list of DNS server IP addresses used by pods with dnsPolicy=ClusterFirst")
+	flags.BoolVar(&f.AdoptForeignSandboxes, "adopt-foreign-sandboxes", f.AdoptForeignSandboxes, "manage sandboxes without the node-name label if their pods are scheduled to this node, otherwise they are ignored")
+	return flags
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/virtual-kubelet/node-cli/opts"
+	"k8s.io/klog"
+)
+
+// node-cli读取pod http server证书的环境变量
+const (
+	certLocationEnv   = "APISERVER_CERT_LOCATION"
+	keyLocationEnv    = "APISERVER_KEY_LOCATION"
+	caCertLocationEnv = "APISERVER_CA_CERT_LOCATION"
+)
+
+// PodServerConfig kubelet API server(默认10250端口)的配置，与node-cli启动pod http server时相同
+type PodServerConfig struct {
+	CertPath                    string
+	KeyPath                     string
+	CACertPath                  string
+	Addr                        string
+	AllowUnauthenticatedClients bool
+	StreamIdleTimeout           time.Duration
+	StreamCreationTimeout       time.Duration
+}
+
+// TakeOverPodServer 在命令行解析之后调用，读取node-cli启动pod http server的配置，
+// 并清除证书环境变量，node-cli因为缺少证书不再启动自己的server，改由ServePods启动，
+// 这样可以注册node-cli没有的attach与portForward路由。
+// 开启webhook认证时node-cli的认证实现无法复用，返回nil，仍由node-cli启动server
+func TakeOverPodServer(o *opts.Opts) *PodServerConfig {
+	if o.Authentication.Webhook.Enabled {
+		klog.Warning("开启了webhook认证，kubelet API server由node-cli启动，不支持attach与port-forward")
+		return nil
+	}
+	cfg := &PodServerConfig{
+		CertPath:                    os.Getenv(certLocationEnv),
+		KeyPath:                     os.Getenv(keyLocationEnv),
+		CACertPath:                  o.ClientCACert,
+		Addr:                        fmt.Sprintf(":%d", o.ListenPort),
+		AllowUnauthenticatedClients: o.AllowUnauthenticatedClients,
+		StreamIdleTimeout:           o.StreamIdleTimeout,
+		StreamCreationTimeout:       o.StreamCreationTimeout,
+	}
+	if cfg.CACertPath == "" {
+		cfg.CACertPath = os.Getenv(caCertLocationEnv)
+	}
+	os.Unsetenv(certLocationEnv)
+	os.Unsetenv(keyLocationEnv)
+	return cfg
+}
+
+// ServePods 启动kubelet API server，ctx结束时关闭。
+// 与node-cli相同，没有提供证书时不启动
+func ServePods(ctx context.Context, cfg *PodServerConfig, handler http.Handler) error {
+	if cfg.CertPath == "" || cfg.KeyPath == "" || (cfg.CACertPath == "" && !cfg.AllowUnauthenticatedClients) {
+		klog.Errorf("TLS certificates not provided, not setting up pod http server, certPath: %s keyPath: %s caPath: %s",
+			cfg.CertPath, cfg.KeyPath, cfg.CACertPath)
+		return nil
+	}
+	tlsCfg, err := loadTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", cfg.Addr, tlsCfg)
+	if err != nil {
+		return fmt.Errorf("error setting up listener for pod http server: %v", err)
+	}
+
+	s := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsCfg,
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	go func() {
+		if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("pod http server exited: %v", err)
+		}
+	}()
+	return nil
+}
+
+// loadTLSConfig 与node-cli相同，要求客户端(apiserver)提供由ca签发的证书
+func loadTLSConfig(cfg *PodServerConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls certs: %v", err)
+	}
+
+	clientAuth := tls.RequireAndVerifyClientCert
+	if cfg.AllowUnauthenticatedClients {
+		clientAuth = tls.NoClientCert
+	}
+
+	var caPool *x509.CertPool
+	if cfg.CACertPath != "" {
+		caPool = x509.NewCertPool()
+		pem, err := ioutil.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		if !caPool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("error appending ca cert to certificate pool")
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientCAs:    caPool,
+		ClientAuth:   clientAuth,
+	}, nil
+}
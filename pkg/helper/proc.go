@@ -0,0 +1,217 @@
+package helper
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clockTicks /proc中cpu时间的单位(USER_HZ)，linux上固定为100
+const clockTicks = 100
+
+// ProcStat 进程的cpu与内存使用情况
+type ProcStat struct {
+	// PPid 父进程的pid
+	PPid int
+	// CPUTime 进程累计使用的cpu时间(用户态+内核态)，单位纳秒
+	CPUTime uint64
+	// ChildrenCPUTime 已退出并被回收的子进程累计使用的cpu时间，单位纳秒
+	ChildrenCPUTime uint64
+	// RSSBytes 进程的常驻内存
+	RSSBytes uint64
+}
+
+// ReadProcStat 读取/proc/<pid>/stat，获取进程的cpu与内存使用情况
+func ReadProcStat(pid int) (*ProcStat, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// 进程名可能包含空格，从最后一个")"之后开始解析
+	s := string(b)
+	idx := strings.LastIndexByte(s, ')')
+	if idx < 0 || idx+2 > len(s) {
+		return nil, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	// fields[0]为第3个字段state，ppid、utime、stime、cutime、cstime、rss分别为第4、14、15、16、17、24个字段
+	fields := strings.Fields(s[idx+2:])
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	var ticks [4]uint64
+	for i := range ticks {
+		ticks[i], err = strconv.ParseUint(fields[11+i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rss, err := strconv.ParseUint(fields[21], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ProcStat{
+		PPid:            ppid,
+		CPUTime:         (ticks[0] + ticks[1]) * uint64(time.Second) / clockTicks,
+		ChildrenCPUTime: (ticks[2] + ticks[3]) * uint64(time.Second) / clockTicks,
+		RSSBytes:        rss * uint64(os.Getpagesize()),
+	}, nil
+}
+
+// ReadAllProcStats 读取/proc下所有进程的cpu与内存使用情况，key为pid。
+// 读取期间退出的进程会被忽略
+func ReadAllProcStats() (map[int]*ProcStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]*ProcStat, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		stat, err := ReadProcStat(pid)
+		if err != nil {
+			continue
+		}
+		procs[pid] = stat
+	}
+	return procs, nil
+}
+
+// ProcTreeStat 汇总pid及其所有子孙进程的cpu与内存使用情况，procs由ReadAllProcStats获取。
+// 子进程退出并被回收后，它的cpu时间计入父进程的ChildrenCPUTime，所以汇总的CPUTime不会因为子进程退出而减少
+func ProcTreeStat(procs map[int]*ProcStat, pid int) (*ProcStat, bool) {
+	root, ok := procs[pid]
+	if !ok {
+		return nil, false
+	}
+	children := make(map[int][]int, len(procs))
+	for p, stat := range procs {
+		children[stat.PPid] = append(children[stat.PPid], p)
+	}
+	total := &ProcStat{PPid: root.PPid}
+	queue := []int{pid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		stat := procs[p]
+		total.CPUTime += stat.CPUTime + stat.ChildrenCPUTime
+		total.RSSBytes += stat.RSSBytes
+		queue = append(queue, children[p]...)
+	}
+	return total, true
+}
+
+// ReadNodeCPUTime 读取/proc/stat，返回节点累计使用的cpu时间(不包括idle与iowait)，单位纳秒
+func ReadNodeCPUTime() (uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[0] != "cpu" {
+			continue
+		}
+		var used uint64
+		// user nice system idle iowait irq softirq steal
+		for i, v := range fields[1:9] {
+			if i == 3 || i == 4 {
+				continue
+			}
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			used += n
+		}
+		return used * uint64(time.Second) / clockTicks, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("cpu line not found in /proc/stat")
+}
+
+// ReadBootTime 读取/proc/stat中的节点启动时间
+func ReadBootTime() (time.Time, error) {
+	b, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			sec, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
+
+// ReadMemInfo 读取/proc/meminfo，返回节点的总内存与可用内存，单位字节
+func ReadMemInfo() (total, available uint64, err error) {
+	b, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// 单位为kB
+		switch fields[0] {
+		case "MemTotal:":
+			total = v * 1024
+		case "MemAvailable:":
+			available = v * 1024
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+	}
+	return total, available, nil
+}
+
+// FsInfo 文件系统的容量信息
+type FsInfo struct {
+	CapacityBytes  uint64
+	AvailableBytes uint64
+	Inodes         uint64
+	InodesFree     uint64
+}
+
+// GetFsInfo 获取path所在文件系统的容量信息
+func GetFsInfo(path string) (*FsInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	return &FsInfo{
+		CapacityBytes:  st.Blocks * uint64(st.Bsize),
+		AvailableBytes: st.Bavail * uint64(st.Bsize),
+		Inodes:         st.Files,
+		InodesFree:     st.Ffree,
+	}, nil
+}
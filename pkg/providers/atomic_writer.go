@@ -0,0 +1,158 @@
+package providers
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// dataDirName 指向当前数据目录的符号链接
+	dataDirName = "..data"
+	// newDataDirName 切换数据目录时使用的临时符号链接
+	newDataDirName = "..data_tmp"
+)
+
+// errPayloadChanged 遍历数据目录时发现文件与payload不一致，用于提前结束遍历
+var errPayloadChanged = errors.New("payload changed")
+
+// writeVolumeFiles 与kubelet的AtomicWriter相同，原子地更新volume中的文件：
+//
+//	<dir>/..2006_01_02_15_04_05.xxx/<path>  实际写入的数据目录
+//	<dir>/..data -> ..2006_01_02_15_04_05.xxx
+//	<dir>/<path顶层目录或文件> -> ..data/<path顶层目录或文件>
+//
+// 数据先写入新的目录，再通过rename替换..data链接，容器中不会读到写了一半的文件
+func writeVolumeFiles(dir string, payload map[string]volumeFile) error {
+	if err := os.MkdirAll(dir, volumeDirPerms); err != nil {
+		return err
+	}
+	dataDirPath := filepath.Join(dir, dataDirName)
+	oldTsDir, err := os.Readlink(dataDirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 内容没有变化时不需要更新
+	if oldTsDir != "" {
+		unchanged, err := payloadUnchanged(filepath.Join(dir, oldTsDir), payload)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+	}
+
+	// 1. 写入新的数据目录
+	tsDir, err := ioutil.TempDir(dir, time.Now().UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tsDir, volumeDirPerms); err != nil {
+		return err
+	}
+	for path, file := range payload {
+		fullPath := filepath.Join(tsDir, path)
+		if err = os.MkdirAll(filepath.Dir(fullPath), volumeDirPerms); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(fullPath, file.data, os.FileMode(file.mode)); err != nil {
+			return err
+		}
+		// WriteFile受umask影响，需要再设置一次权限
+		if err = os.Chmod(fullPath, os.FileMode(file.mode)); err != nil {
+			return err
+		}
+	}
+
+	// 2. 通过rename原子地替换..data链接
+	newDataDirPath := filepath.Join(dir, newDataDirName)
+	if err = os.Remove(newDataDirPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.Symlink(filepath.Base(tsDir), newDataDirPath); err != nil {
+		return err
+	}
+	if err = os.Rename(newDataDirPath, dataDirPath); err != nil {
+		return err
+	}
+
+	// 3. 创建新增的用户可见链接，删除不再需要的链接
+	visible := make(map[string]bool, len(payload))
+	for path := range payload {
+		visible[strings.SplitN(path, "/", 2)[0]] = true
+	}
+	for name := range visible {
+		link := filepath.Join(dir, name)
+		if _, err = os.Lstat(link); os.IsNotExist(err) {
+			if err = os.Symlink(filepath.Join(dataDirName, name), link); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "..") || visible[entry.Name()] {
+			continue
+		}
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if err = os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 4. 删除旧的数据目录
+	if oldTsDir != "" {
+		if err = os.RemoveAll(filepath.Join(dir, oldTsDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payloadUnchanged 比较数据目录中的文件与payload是否一致
+func payloadUnchanged(tsDir string, payload map[string]volumeFile) (bool, error) {
+	count := 0
+	err := filepath.Walk(tsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(tsDir, path)
+		if err != nil {
+			return err
+		}
+		file, ok := payload[filepath.ToSlash(rel)]
+		if !ok || info.Mode().Perm() != os.FileMode(file.mode).Perm() {
+			return errPayloadChanged
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, file.data) {
+			return errPayloadChanged
+		}
+		count++
+		return nil
+	})
+	if errors.Is(err, errPayloadChanged) || os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return count == len(payload), nil
+}
@@ -0,0 +1,107 @@
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteVolumeFiles(t *testing.T) {
+	dir := t.TempDir()
+	steps := []struct {
+		name    string
+		payload map[string]volumeFile
+		// missing 更新后不应该存在的文件
+		missing []string
+	}{
+		{
+			name: "initial",
+			payload: map[string]volumeFile{
+				"a":     {data: []byte("A"), mode: 0644},
+				"sub/b": {data: []byte("B"), mode: 0600},
+			},
+		},
+		{
+			name: "update content",
+			payload: map[string]volumeFile{
+				"a":     {data: []byte("A2"), mode: 0644},
+				"sub/b": {data: []byte("B"), mode: 0600},
+			},
+		},
+		{
+			name:    "remove file",
+			payload: map[string]volumeFile{"a": {data: []byte("A2"), mode: 0644}},
+			missing: []string{"sub", "sub/b"},
+		},
+		{
+			name:    "change mode",
+			payload: map[string]volumeFile{"a": {data: []byte("A2"), mode: 0400}},
+		},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := writeVolumeFiles(dir, step.payload); err != nil {
+				t.Fatalf("writeVolumeFiles() err = %v", err)
+			}
+			for path, file := range step.payload {
+				full := filepath.Join(dir, path)
+				data, err := ioutil.ReadFile(full)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != string(file.data) {
+					t.Errorf("%s = %q, want %q", path, data, file.data)
+				}
+				info, err := os.Stat(full)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != os.FileMode(file.mode) {
+					t.Errorf("%s mode = %o, want %o", path, info.Mode().Perm(), file.mode)
+				}
+			}
+			for _, path := range step.missing {
+				if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+					t.Errorf("%s should be removed, err = %v", path, err)
+				}
+			}
+			// 只保留一个数据目录
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataDirs := 0
+			for _, entry := range entries {
+				if entry.IsDir() && entry.Name() != dataDirName {
+					dataDirs++
+				}
+			}
+			if dataDirs != 1 {
+				t.Errorf("found %d data directories, want 1", dataDirs)
+			}
+		})
+	}
+}
+
+func TestWriteVolumeFilesUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	payload := map[string]volumeFile{"a": {data: []byte("A"), mode: 0644}}
+	if err := writeVolumeFiles(dir, payload); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Readlink(filepath.Join(dir, dataDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeVolumeFiles(dir, payload); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Readlink(filepath.Join(dir, dataDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("data directory changed from %s to %s without content change", before, after)
+	}
+}
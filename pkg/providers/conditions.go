@@ -0,0 +1,194 @@
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// 与kubelet一致的condition原因
+	reasonContainersNotReady       = "ContainersNotReady"
+	reasonContainersNotInitialized = "ContainersNotInitialized"
+	reasonReadinessGatesNotReady   = "ReadinessGatesNotReady"
+	reasonPodCompleted             = "PodCompleted"
+)
+
+// podConditions 记录pod每个condition最近一次变化的时间
+type podConditions struct {
+	mu          sync.Mutex
+	transitions map[v1.PodConditionType]conditionTransition
+}
+
+// conditionTransition condition的状态与变化时间
+type conditionTransition struct {
+	status v1.ConditionStatus
+	time   metav1.Time
+}
+
+// newPodConditions 创建pod的condition记录
+func newPodConditions() *podConditions {
+	return &podConditions{transitions: map[v1.PodConditionType]conditionTransition{}}
+}
+
+// observe 记录condition的状态，状态变化时更新LastTransitionTime，第一次记录时使用since
+func (pc *podConditions) observe(condition *v1.PodCondition, since metav1.Time) {
+	if pc == nil {
+		condition.LastTransitionTime = since
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	last, ok := pc.transitions[condition.Type]
+	if ok && last.status == condition.Status {
+		condition.LastTransitionTime = last.time
+		return
+	}
+	if ok {
+		since = metav1.NewTime(time.Now())
+	}
+	pc.transitions[condition.Type] = conditionTransition{status: condition.Status, time: since}
+	condition.LastTransitionTime = since
+}
+
+// createPodConditions 生成PodScheduled、Initialized、ContainersReady与Ready，
+// 并保留readinessGates对应的condition，避免上报状态时被覆盖
+func createPodConditions(p *PodStatus, phase v1.PodPhase, statuses []v1.ContainerStatus) []v1.PodCondition {
+	created := metav1.NewTime(time.Unix(0, p.status.CreatedAt))
+	now := metav1.NewTime(time.Now())
+
+	scheduled := v1.PodCondition{Type: v1.PodScheduled, Status: v1.ConditionTrue}
+	p.conditions.observe(&scheduled, created)
+
+	initialized := podInitializedCondition(p)
+	p.conditions.observe(&initialized, created)
+
+	containersReady := containersReadyCondition(p, phase, statuses)
+	p.conditions.observe(&containersReady, now)
+
+	ready := podReadyCondition(p, containersReady)
+	p.conditions.observe(&ready, now)
+
+	conditions := []v1.PodCondition{scheduled, initialized, containersReady, ready}
+	return append(conditions, p.gates...)
+}
+
+// podInitializedCondition 所有init容器都成功退出后为True
+func podInitializedCondition(p *PodStatus) v1.PodCondition {
+	condition := v1.PodCondition{Type: v1.PodInitialized, Status: v1.ConditionTrue}
+	if p.pod == nil || len(p.pod.Spec.InitContainers) == 0 {
+		return condition
+	}
+	var pending []string
+	for _, container := range p.pod.Spec.InitContainers {
+		if !p.initCompleted(container.Name) {
+			pending = append(pending, container.Name)
+		}
+	}
+	if len(pending) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = reasonContainersNotInitialized
+		condition.Message = fmt.Sprintf("containers with incomplete status: [%s]", strings.Join(pending, " "))
+	}
+	return condition
+}
+
+// containersReadyCondition 所有容器都ready时为True，pod结束后为False
+func containersReadyCondition(p *PodStatus, phase v1.PodPhase, statuses []v1.ContainerStatus) v1.PodCondition {
+	condition := v1.PodCondition{Type: v1.ContainersReady, Status: v1.ConditionTrue}
+	if phase == v1.PodSucceeded || phase == v1.PodFailed {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = reasonPodCompleted
+		return condition
+	}
+
+	ready := make(map[string]bool, len(statuses))
+	for _, status := range statuses {
+		ready[status.Name] = status.Ready
+	}
+	var names []string
+	if p.pod != nil && p.cmds == nil {
+		for _, container := range p.pod.Spec.Containers {
+			names = append(names, container.Name)
+		}
+	} else {
+		for name := range ready {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var unready []string
+	for _, name := range names {
+		if !ready[name] {
+			unready = append(unready, name)
+		}
+	}
+	if len(unready) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = reasonContainersNotReady
+		condition.Message = fmt.Sprintf("containers with unready status: [%s]", strings.Join(unready, " "))
+	}
+	return condition
+}
+
+// podReadyCondition 容器都ready并且readinessGates都为True时为True
+func podReadyCondition(p *PodStatus, containersReady v1.PodCondition) v1.PodCondition {
+	condition := v1.PodCondition{Type: v1.PodReady, Status: v1.ConditionTrue}
+	if containersReady.Status != v1.ConditionTrue {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = containersReady.Reason
+		condition.Message = containersReady.Message
+		return condition
+	}
+	if p.pod == nil {
+		return condition
+	}
+
+	gates := make(map[v1.PodConditionType]v1.ConditionStatus, len(p.gates))
+	for _, gate := range p.gates {
+		gates[gate.Type] = gate.Status
+	}
+	var messages []string
+	for _, gate := range p.pod.Spec.ReadinessGates {
+		status, ok := gates[gate.ConditionType]
+		if !ok {
+			messages = append(messages, fmt.Sprintf("corresponding condition of pod readiness gate %q does not exist.", gate.ConditionType))
+		} else if status != v1.ConditionTrue {
+			messages = append(messages, fmt.Sprintf("the status of pod readiness gate %q is not \"True\", but %v", gate.ConditionType, status))
+		}
+	}
+	if len(messages) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = reasonReadinessGatesNotReady
+		condition.Message = strings.Join(messages, ", ")
+	}
+	return condition
+}
+
+// readinessGateConditions 从apiserver中的pod获取readinessGates对应的condition，
+// 这些condition由其他控制器设置
+func (c *CriProvider) readinessGateConditions(pod *v1.Pod) []v1.PodCondition {
+	if pod == nil || len(pod.Spec.ReadinessGates) == 0 || c.resourceManager == nil {
+		return nil
+	}
+	for _, apiPod := range c.resourceManager.GetPods() {
+		if apiPod.UID != pod.UID {
+			continue
+		}
+		var conditions []v1.PodCondition
+		for _, gate := range pod.Spec.ReadinessGates {
+			for _, condition := range apiPod.Status.Conditions {
+				if condition.Type == gate.ConditionType {
+					conditions = append(conditions, condition)
+				}
+			}
+		}
+		return conditions
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"fmt"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -10,7 +11,7 @@ import (
 
 // createPodSpecFromCRI 由CRI配置创建出pod对象
 func createPodSpecFromCRI(p *PodStatus, nodeName string) *v1.Pod {
-	cSpecs, _ := createContainerSpecsFromCRI(p.containers)
+	cSpecs, _ := createContainerSpecsFromCRI(p)
 
 	// TODO: Fill out more fields here
 	podSpec := v1.Pod{
@@ -37,7 +38,8 @@ func createPodSpecFromCRI(p *PodStatus, nodeName string) *v1.Pod {
 }
 
 // createContainerSpecsFromCRI 由CRI配置创建出Container与ContainerStatus
-func createContainerSpecsFromCRI(containerMap map[string]*criapi.ContainerStatus) ([]v1.Container, []v1.ContainerStatus) {
+func createContainerSpecsFromCRI(p *PodStatus) ([]v1.Container, []v1.ContainerStatus) {
+	containerMap := p.containers
 	containers := make([]v1.Container, 0, len(containerMap))
 	containerStatuses := make([]v1.ContainerStatus, 0, len(containerMap))
 	for _, c := range containerMap {
@@ -49,23 +51,100 @@ func createContainerSpecsFromCRI(containerMap map[string]*criapi.ContainerStatus
 			//Command:    Command is buried in the Info JSON,
 		}
 		containers = append(containers, container)
-		// TODO: Fill out more fields
-		containerStatus := v1.ContainerStatus{
-			Name:        c.Metadata.Name,
-			Image:       handleImage(c),
-			ImageID:     handleImageRef(c),
-			ContainerID: c.Id,
-			Ready:       c.State == criapi.ContainerState_CONTAINER_RUNNING,
-			State:       *createContainerStateFromCRI(c.State, c),
-			// LastTerminationState:
-			// RestartCount:
+		containerStatus := createContainerStatusFromCRI(p, c)
+		// 配置了探针的容器，由探针结果决定ready与started
+		started := containerStatus.Ready
+		if probe, ok := p.probes[c.Metadata.Name]; ok {
+			containerStatus.Ready = probe.ready
+			started = probe.started
 		}
+		containerStatus.Started = &started
 
 		containerStatuses = append(containerStatuses, containerStatus)
 	}
+
+	// 还没有创建的容器，init容器运行期间显示为PodInitializing
+	if p.pod != nil && p.cmds == nil {
+		reason := "ContainerCreating"
+		if !p.initialized() {
+			reason = "PodInitializing"
+		}
+		for _, spec := range p.pod.Spec.Containers {
+			if _, ok := containerMap[spec.Name]; ok {
+				continue
+			}
+			containers = append(containers, v1.Container{Name: spec.Name, Image: spec.Image})
+			containerStatuses = append(containerStatuses, pendingContainerStatus(spec, p, reason))
+		}
+	}
 	return containers, containerStatuses
 }
 
+// createInitContainerStatusesFromCRI 按照pod中的顺序生成init容器的状态，成功退出的init容器为ready
+func createInitContainerStatusesFromCRI(p *PodStatus) []v1.ContainerStatus {
+	if p.pod == nil {
+		return nil
+	}
+	statuses := make([]v1.ContainerStatus, 0, len(p.pod.Spec.InitContainers))
+	for _, spec := range p.pod.Spec.InitContainers {
+		c, ok := p.initContainers[spec.Name]
+		if !ok {
+			// 简易pod中没有命令的容器不会运行
+			if _, isCmd := p.cmds[spec.Name]; p.cmds != nil && !isCmd {
+				continue
+			}
+			statuses = append(statuses, pendingContainerStatus(spec, p, "PodInitializing"))
+			continue
+		}
+		status := createContainerStatusFromCRI(p, c)
+		status.Ready = c.State == criapi.ContainerState_CONTAINER_EXITED && c.ExitCode == 0
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// createContainerStatusFromCRI 由CRI中容器的状态生成ContainerStatus，包含重启次数、上一次的状态与退避原因
+func createContainerStatusFromCRI(p *PodStatus, c *criapi.ContainerStatus) v1.ContainerStatus {
+	// TODO: Fill out more fields
+	containerStatus := v1.ContainerStatus{
+		Name:        c.Metadata.Name,
+		Image:       handleImage(c),
+		ImageID:     handleImageRef(c),
+		ContainerID: c.Id,
+		Ready:       c.State == criapi.ContainerState_CONTAINER_RUNNING,
+		State:       *createContainerStateFromCRI(c.State, c),
+		// 每次重启时attempt加1
+		RestartCount: int32(c.Metadata.Attempt),
+	}
+	if previous, ok := p.previousStatus(c.Metadata.Name); ok {
+		containerStatus.LastTerminationState = *createContainerStateFromCRI(previous.State, previous)
+	}
+	// 退避中的容器显示为等待状态，刚退出的容器作为上一次的状态
+	if waiting, ok := p.waitingState(c.Metadata.Name); ok {
+		if c.State == criapi.ContainerState_CONTAINER_EXITED {
+			containerStatus.LastTerminationState = containerStatus.State
+		}
+		containerStatus.State = v1.ContainerState{Waiting: waiting}
+	}
+	return containerStatus
+}
+
+// pendingContainerStatus 还没有创建的容器的状态
+func pendingContainerStatus(spec v1.Container, p *PodStatus, reason string) v1.ContainerStatus {
+	waiting := &v1.ContainerStateWaiting{Reason: reason}
+	// 创建失败时显示失败原因
+	if w, ok := p.waitingState(spec.Name); ok {
+		waiting = w
+	}
+	started := false
+	return v1.ContainerStatus{
+		Name:    spec.Name,
+		Image:   spec.Image,
+		State:   v1.ContainerState{Waiting: waiting},
+		Started: &started,
+	}
+}
+
 // createContainerStateFromCRI 转换为ContainerState
 func createContainerStateFromCRI(state criapi.ContainerState, status *criapi.ContainerStatus) *v1.ContainerState {
 	var result *v1.ContainerState
@@ -99,28 +178,114 @@ func createContainerStateFromCRI(state criapi.ContainerState, status *criapi.Con
 	return result
 }
 
+// podReasonSandboxNotReady sandbox异常退出时pod的原因
+const podReasonSandboxNotReady = "SandboxNotReady"
+
 // createPodStatusFromCRI 由CRI配置创建出pod对象
 func createPodStatusFromCRI(p *PodStatus) *v1.PodStatus {
-	_, cStatuses := createContainerSpecsFromCRI(p.containers)
+	_, cStatuses := createContainerSpecsFromCRI(p)
 
-	phase := v1.PodPending
-	if p.status.State == criapi.PodSandboxState_SANDBOX_READY {
-		phase = v1.PodRunning
+	phase := getPodPhase(p, cStatuses)
+	reason, message := "", ""
+	// sandbox异常退出后不会重建，容器无法再运行；删除pod时sandbox由我们停止，按照容器状态计算
+	if p.status.State != criapi.PodSandboxState_SANDBOX_READY && !p.terminating && phase != v1.PodSucceeded {
+		phase = v1.PodFailed
+		reason = podReasonSandboxNotReady
+		message = fmt.Sprintf("Pod sandbox %s is not ready", p.status.Id)
 	}
 	startTime := metav1.NewTime(time.Unix(0, p.status.CreatedAt))
 	return &v1.PodStatus{
-		Phase:             phase,
-		Conditions:        []v1.PodCondition{},
-		Message:           "",
-		Reason:            "",
-		HostIP:            "",
-		PodIP:             handleNetworkIp(p),
-		StartTime:         &startTime,
-		ContainerStatuses: cStatuses,
+		Phase:                 phase,
+		Conditions:            createPodConditions(p, phase, cStatuses),
+		Message:               message,
+		Reason:                reason,
+		HostIP:                "",
+		PodIP:                 handleNetworkIp(p),
+		StartTime:             &startTime,
+		ContainerStatuses:     cStatuses,
+		InitContainerStatuses: createInitContainerStatusesFromCRI(p),
 	}
 }
 
+// getPodPhase 与kubelet一致，由容器状态与restartPolicy计算pod的phase
+func getPodPhase(p *PodStatus, statuses []v1.ContainerStatus) v1.PodPhase {
+	byName := make(map[string]*v1.ContainerStatus, len(statuses))
+	for i := range statuses {
+		byName[statuses[i].Name] = &statuses[i]
+	}
+	// 简易pod中没有命令的容器不会运行，只统计已有的状态
+	names := make([]string, 0, len(statuses))
+	if p.pod != nil && p.cmds == nil {
+		for _, container := range p.pod.Spec.Containers {
+			names = append(names, container.Name)
+		}
+	} else {
+		for _, status := range statuses {
+			names = append(names, status.Name)
+		}
+	}
+
+	var waiting, running, stopped, succeeded, unknown int
+	for _, name := range names {
+		status, ok := byName[name]
+		if !ok {
+			unknown++
+			continue
+		}
+		switch {
+		case status.State.Running != nil:
+			running++
+		case status.State.Terminated != nil:
+			stopped++
+			if status.State.Terminated.ExitCode == 0 {
+				succeeded++
+			}
+		case status.State.Waiting != nil:
+			// 退避中的容器已经运行过，按照上一次的状态计算
+			if status.LastTerminationState.Terminated != nil {
+				stopped++
+			} else {
+				waiting++
+			}
+		default:
+			unknown++
+		}
+	}
+
+	policy := p.restartPolicy()
+	// init容器没有全部完成时，restartPolicy为Never并且init容器失败则pod失败，否则等待初始化
+	if !p.initialized() {
+		if policy == v1.RestartPolicyNever && p.initFailed() {
+			return v1.PodFailed
+		}
+		return v1.PodPending
+	}
+	switch {
+	case waiting > 0:
+		return v1.PodPending
+	case running > 0 && unknown == 0:
+		// 有容器仍在运行，或者退出的容器会被重启
+		return v1.PodRunning
+	case running == 0 && stopped > 0 && unknown == 0:
+		if policy == v1.RestartPolicyAlways {
+			return v1.PodRunning
+		}
+		if stopped == succeeded {
+			return v1.PodSucceeded
+		}
+		if policy == v1.RestartPolicyNever {
+			return v1.PodFailed
+		}
+		return v1.PodRunning
+	}
+	return v1.PodPending
+}
+
 func handleNetworkIp(pp *PodStatus) (string) {
+	// hostNetwork的sandbox没有ip，与kubelet相同使用节点ip
+	if pp.pod != nil && pp.pod.Spec.HostNetwork {
+		return pp.pod.Status.HostIP
+	}
 	if pp.status.Network == nil {
 		return ""
 	}
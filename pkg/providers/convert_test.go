@@ -0,0 +1,146 @@
+package providers
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func runningStatus(name string) v1.ContainerStatus {
+	return v1.ContainerStatus{Name: name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}
+}
+
+func terminatedStatus(name string, exitCode int32) v1.ContainerStatus {
+	return v1.ContainerStatus{Name: name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: exitCode}}}
+}
+
+func waitingStatus(name string, lastExitCode *int32) v1.ContainerStatus {
+	status := v1.ContainerStatus{Name: name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}}
+	if lastExitCode != nil {
+		status.LastTerminationState.Terminated = &v1.ContainerStateTerminated{ExitCode: *lastExitCode}
+	}
+	return status
+}
+
+func TestGetPodPhase(t *testing.T) {
+	one := int32(1)
+	newPod := func(policy v1.RestartPolicy, initContainers ...string) *v1.Pod {
+		pod := &v1.Pod{Spec: v1.PodSpec{
+			RestartPolicy: policy,
+			Containers:    []v1.Container{{Name: "a"}, {Name: "b"}},
+		}}
+		for _, name := range initContainers {
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{Name: name})
+		}
+		return pod
+	}
+	initStatus := func(state criapi.ContainerState, exitCode int32) map[string]*criapi.ContainerStatus {
+		return map[string]*criapi.ContainerStatus{"init": {State: state, ExitCode: exitCode}}
+	}
+
+	tests := []struct {
+		name     string
+		pod      *v1.Pod
+		init     map[string]*criapi.ContainerStatus
+		statuses []v1.ContainerStatus
+		want     v1.PodPhase
+	}{
+		{
+			name:     "all running",
+			pod:      newPod(v1.RestartPolicyAlways),
+			statuses: []v1.ContainerStatus{runningStatus("a"), runningStatus("b")},
+			want:     v1.PodRunning,
+		},
+		{
+			name:     "container not created",
+			pod:      newPod(v1.RestartPolicyAlways),
+			statuses: []v1.ContainerStatus{runningStatus("a")},
+			want:     v1.PodPending,
+		},
+		{
+			name:     "container waiting",
+			pod:      newPod(v1.RestartPolicyAlways),
+			statuses: []v1.ContainerStatus{runningStatus("a"), waitingStatus("b", nil)},
+			want:     v1.PodPending,
+		},
+		{
+			name:     "crash loop back-off",
+			pod:      newPod(v1.RestartPolicyAlways),
+			statuses: []v1.ContainerStatus{runningStatus("a"), waitingStatus("b", &one)},
+			want:     v1.PodRunning,
+		},
+		{
+			name:     "running and exited",
+			pod:      newPod(v1.RestartPolicyNever),
+			statuses: []v1.ContainerStatus{runningStatus("a"), terminatedStatus("b", 1)},
+			want:     v1.PodRunning,
+		},
+		{
+			name:     "all succeeded with Always",
+			pod:      newPod(v1.RestartPolicyAlways),
+			statuses: []v1.ContainerStatus{terminatedStatus("a", 0), terminatedStatus("b", 0)},
+			want:     v1.PodRunning,
+		},
+		{
+			name:     "all succeeded with OnFailure",
+			pod:      newPod(v1.RestartPolicyOnFailure),
+			statuses: []v1.ContainerStatus{terminatedStatus("a", 0), terminatedStatus("b", 0)},
+			want:     v1.PodSucceeded,
+		},
+		{
+			name:     "all succeeded with Never",
+			pod:      newPod(v1.RestartPolicyNever),
+			statuses: []v1.ContainerStatus{terminatedStatus("a", 0), terminatedStatus("b", 0)},
+			want:     v1.PodSucceeded,
+		},
+		{
+			name:     "failed with Never",
+			pod:      newPod(v1.RestartPolicyNever),
+			statuses: []v1.ContainerStatus{terminatedStatus("a", 0), terminatedStatus("b", 1)},
+			want:     v1.PodFailed,
+		},
+		{
+			name:     "failed with OnFailure",
+			pod:      newPod(v1.RestartPolicyOnFailure),
+			statuses: []v1.ContainerStatus{terminatedStatus("a", 0), terminatedStatus("b", 1)},
+			want:     v1.PodRunning,
+		},
+		{
+			name:     "init container running",
+			pod:      newPod(v1.RestartPolicyNever, "init"),
+			init:     initStatus(criapi.ContainerState_CONTAINER_RUNNING, 0),
+			statuses: []v1.ContainerStatus{waitingStatus("a", nil), waitingStatus("b", nil)},
+			want:     v1.PodPending,
+		},
+		{
+			name:     "init container failed with Never",
+			pod:      newPod(v1.RestartPolicyNever, "init"),
+			init:     initStatus(criapi.ContainerState_CONTAINER_EXITED, 1),
+			statuses: []v1.ContainerStatus{waitingStatus("a", nil), waitingStatus("b", nil)},
+			want:     v1.PodFailed,
+		},
+		{
+			name:     "init container failed with Always",
+			pod:      newPod(v1.RestartPolicyAlways, "init"),
+			init:     initStatus(criapi.ContainerState_CONTAINER_EXITED, 1),
+			statuses: []v1.ContainerStatus{waitingStatus("a", nil), waitingStatus("b", nil)},
+			want:     v1.PodPending,
+		},
+		{
+			name:     "init container succeeded",
+			pod:      newPod(v1.RestartPolicyNever, "init"),
+			init:     initStatus(criapi.ContainerState_CONTAINER_EXITED, 0),
+			statuses: []v1.ContainerStatus{runningStatus("a"), runningStatus("b")},
+			want:     v1.PodRunning,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PodStatus{pod: tt.pod, initContainers: tt.init}
+			if got := getPodPhase(p, tt.statuses); got != tt.want {
+				t.Errorf("getPodPhase() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
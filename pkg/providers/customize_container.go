@@ -1,12 +1,19 @@
 package providers
 
 import (
-	"bytes"
 	"context"
+	"fmt"
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"io"
 	v1 "k8s.io/api/core/v1"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -14,52 +21,210 @@ import (
 type ContainerCmd struct {
 	Cmd           *exec.Cmd `json:"cmd"`
 	ContainerName string    `json:"container_name"`
+	LogPath       string    `json:"log_path"`
 	ExitCode      int       `json:"exit_code"`
 	ExecError     error     `json:"exec_error"`
+	// Attempt 命令的重启次数
+	Attempt uint32 `json:"attempt"`
+	// Previous 上一次执行的状态，重启过时才有
+	Previous *criapi.ContainerStatus `json:"-"`
+	// Waiting 处于重启退避中时的等待原因
+	Waiting *v1.ContainerStateWaiting `json:"-"`
+
+	// mu 与所属pod的PodStatus.sampleMu相同，保护Cmd、LogPath、Attempt、Previous、Waiting
+	// 以及下面的字段；ExitCode与ExecError只由执行命令的goroutine读写
+	mu *sync.Mutex
+	// pid 命令运行中时的进程号，退出后为0
+	pid int
+	// exited 命令运行中时不为nil，退出并更新状态后关闭
+	exited chan struct{}
+	// terminating pod正在删除，命令退出后不再重启
+	terminating bool
 }
 
-// Run 执行命令
+// snapshot 复制命令的状态，用于在锁外读取，调用时需要持有cc.mu
+func (cc *ContainerCmd) snapshot() *ContainerCmd {
+	return &ContainerCmd{
+		Cmd:           cc.Cmd,
+		ContainerName: cc.ContainerName,
+		LogPath:       cc.LogPath,
+		Attempt:       cc.Attempt,
+		Previous:      cc.Previous,
+		Waiting:       cc.Waiting,
+		pid:           cc.pid,
+	}
+}
+
+// renew exec.Cmd只能执行一次，重启时以相同的命令、工作目录与环境变量创建新的Cmd，调用时需要持有cc.mu
+func (cc *ContainerCmd) renew(ctx context.Context, logPath string, attempt uint32) {
+	cmd := exec.CommandContext(ctx, cc.Cmd.Path, cc.Cmd.Args[1:]...)
+	cmd.Dir = cc.Cmd.Dir
+	cmd.Env = cc.Cmd.Env
+	cc.Cmd = cmd
+	cc.LogPath = logPath
+	cc.Attempt = attempt
+}
+
+// Run 执行命令，输出写入日志文件，返回标准输出与标准错误末尾的部分内容
 func (cc *ContainerCmd) Run() (string, string, error) {
-	// 设置输出
-	var stdout, stderr bytes.Buffer
-	cc.Cmd.Stdout = &stdout
-	cc.Cmd.Stderr = &stderr
-	// 执行cmd
-	err := cc.Cmd.Run()
+	cc.ExitCode = 0
+	cc.ExecError = nil
+	lw, err := newCRILogWriter(cc.LogPath, samplePodLogMaxSize, samplePodLogMaxFiles)
+	if err != nil {
+		cc.ExitCode = -9999
+		cc.ExecError = err
+		return "", "", err
+	}
+	defer lw.Close()
+
+	// 设置输出，日志文件中保留全部输出，状态中只保留末尾部分
+	stdout, stderr := newTailBuffer(maxStatusMessageSize), newTailBuffer(maxStatusMessageSize)
+	outStream, errStream := lw.Stream("stdout"), lw.Stream("stderr")
+	cc.Cmd.Stdout = io.MultiWriter(outStream, stdout)
+	cc.Cmd.Stderr = io.MultiWriter(errStream, stderr)
+	// 执行cmd，启动时记录运行状态，删除pod时用于发送信号
+	cc.mu.Lock()
+	err = cc.Cmd.Start()
+	if err == nil {
+		cc.pid = cc.Cmd.Process.Pid
+	}
+	cc.exited = make(chan struct{})
+	cc.mu.Unlock()
+	if err == nil {
+		err = cc.Cmd.Wait()
+	}
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			exitCode := exitError.ExitCode()
+			// 被信号终止时与容器运行时一致，退出码为128+信号
+			if ws, ok := exitError.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				exitCode = 128 + int(ws.Signal())
+			}
 			cc.ExitCode = exitCode
 		} else {
 			cc.ExitCode = -9999 //代表是其他错误
 			cc.ExecError = err
 		}
 	}
-	return string(stdout.Bytes()), string(stderr.Bytes()),err
+	_ = outStream.Flush()
+	_ = errStream.Flush()
+	return stdout.String(), stderr.String(), err
 }
 
-func (c *CriProvider) createSamplePod(_ context.Context, pod *v1.Pod) error {
-	// 1. 封装为ContainerCmd对象
-	cmds := make([]*ContainerCmd, 0)
-	for _, c := range pod.Spec.Containers {
-		if len(c.Command) == 0 {
-			continue
+// markExited 命令退出并且状态已经更新
+func (cc *ContainerCmd) markExited() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.pid = 0
+	if cc.exited != nil {
+		close(cc.exited)
+		cc.exited = nil
+	}
+}
+
+// isTerminating pod是否正在删除
+func (cc *ContainerCmd) isTerminating() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.terminating
+}
+
+// terminate 先发送SIGTERM，超过gracePeriod后发送SIGKILL，等待命令退出并更新状态
+func (cc *ContainerCmd) terminate(gracePeriod time.Duration) {
+	cc.mu.Lock()
+	cc.terminating = true
+	exited, process := cc.exited, cc.Cmd.Process
+	cc.mu.Unlock()
+	if exited == nil || process == nil {
+		return
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		klog.Errorf("send SIGTERM to container %s err: %s", cc.ContainerName, err)
+	}
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		return
+	case <-timer.C:
+	}
+	klog.Infof("container %s did not exit in %s, killing it", cc.ContainerName, gracePeriod)
+	if err := process.Kill(); err != nil {
+		klog.Errorf("kill container %s err: %s", cc.ContainerName, err)
+	}
+	<-exited
+}
+
+func (c *CriProvider) createSamplePod(_ context.Context, pod *v1.Pod) (err error) {
+	logPath := filepath.Join(c.podLogRoot, string(pod.UID))
+	err = os.MkdirAll(logPath, PodLogRootPerms)
+	if err != nil {
+		return err
+	}
+	// 解析环境变量，简易pod的进程运行在本机网络中，podIP即为节点ip
+	runtimePod := pod.DeepCopy()
+	runtimePod.Status.HostIP = c.options.InternalIp
+	runtimePod.Status.PodIP = c.options.InternalIp
+	runtimePod.Status.PodIPs = []v1.PodIP{{IP: c.options.InternalIp}}
+	containerEnvs := make(map[string][]v1.EnvVar, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			envs, err := c.makeEnvironmentVariables(runtimePod, &containers[i])
+			if err != nil {
+				return err
+			}
+			containerEnvs[containers[i].Name] = envs
 		}
-		args := make([]string, 0)
-		if len(c.Command) > 1 {
-			args = append(args, c.Command[1:]...)
+	}
+	// pod删除时上下文结束，停止命令并不再重启
+	ctx, s := c.registerSupervisor(&podRuntime{pod: runtimePod})
+	// 创建失败时结束上下文，不留下没有pod的supervisor
+	defer func() {
+		if err != nil {
+			s.cancel()
+			c.stopSupervisor(pod.UID)
 		}
-		args = append(args, c.Args...)
-		cmd := exec.Command(c.Command[0], args...)
-		cmds = append(cmds, &ContainerCmd{
-			Cmd:           cmd,
-			ContainerName: c.Name,
-		})
+	}()
+	mu := &sync.Mutex{}
 
+	// 1. 封装为ContainerCmd对象，init容器与应用容器分开，init容器按顺序执行
+	newCmds := func(containers []v1.Container) []*ContainerCmd {
+		cmds := make([]*ContainerCmd, 0)
+		for _, c := range containers {
+			if len(c.Command) == 0 {
+				continue
+			}
+			envs := containerEnvs[c.Name]
+			expandContainerCommand(&c, envs)
+			args := make([]string, 0)
+			if len(c.Command) > 1 {
+				args = append(args, c.Command[1:]...)
+			}
+			args = append(args, c.Args...)
+			cmd := exec.CommandContext(ctx, c.Command[0], args...)
+			cmd.Dir = c.WorkingDir
+			cmd.Env = os.Environ()
+			for _, env := range envs {
+				cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+			}
+			cmds = append(cmds, &ContainerCmd{
+				Cmd:           cmd,
+				ContainerName: c.Name,
+				LogPath:       filepath.Join(logPath, remote.ContainerLogFileName(c.Name, 0)),
+				mu:            mu,
+			})
+		}
+		return cmds
 	}
+	initCmds := newCmds(pod.Spec.InitContainers)
+	cmds := newCmds(pod.Spec.Containers)
 
 	// 2. 创建pod状态
-	c.PodManager.samplePodStatus[pod.UID] = PodStatus{
+	cmdMap := make(map[string]*ContainerCmd, len(initCmds)+len(cmds))
+	for _, cmd := range append(append([]*ContainerCmd{}, initCmds...), cmds...) {
+		cmdMap[cmd.ContainerName] = cmd
+	}
+	ps := PodStatus{
 		id: string(pod.UID),
 		status: &criapi.PodSandboxStatus{
 			Metadata: &criapi.PodSandboxMetadata{
@@ -69,70 +234,190 @@ func (c *CriProvider) createSamplePod(_ context.Context, pod *v1.Pod) error {
 			},
 			Id:        string(pod.UID),
 			State:     criapi.PodSandboxState_SANDBOX_READY,
-			CreatedAt: time.Now().Unix(),
+			CreatedAt: time.Now().UnixNano(),
 		},
-		containers: map[string]*criapi.ContainerStatus{},
+		containers:     map[string]*criapi.ContainerStatus{},
+		initContainers: map[string]*criapi.ContainerStatus{},
+		pod:            runtimePod,
+		conditions:     c.PodManager.podConditions(pod.UID),
+		cmds:           cmdMap,
+		sampleMu:       mu,
+	}
+	for _, cmd := range initCmds {
+		ps.initContainers[cmd.ContainerName] = newSampleContainerStatus(pod, cmd, "PodInitializing")
 	}
-	// 通知去更新状态
-	c.notifyC <- struct{}{}
-
 	for _, cmd := range cmds {
-		c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName] = &criapi.ContainerStatus{
-			Metadata: &criapi.ContainerMetadata{
-				Name: cmd.ContainerName,
-			},
-			Id:        string(pod.UID) + cmd.ContainerName,
-			CreatedAt: time.Now().Unix(),
-			StartedAt: time.Now().Add(time.Second * 3).Unix(),
-			State:     criapi.ContainerState_CONTAINER_CREATED,
-			Message: "Creating",
+		reason := ""
+		if len(initCmds) > 0 {
+			reason = "PodInitializing"
 		}
+		ps.containers[cmd.ContainerName] = newSampleContainerStatus(pod, cmd, reason)
+	}
+	c.PodManager.setSamplePod(pod.UID, ps)
+	// 通知去更新状态
+	c.notifySamplePods()
+	// 执行命令，按照restartPolicy重启
+	go c.runSamplePod(ctx, runtimePod, ps, initCmds, cmds)
 
-		c.notifyC <- struct{}{}
-
-		// 修改容器状态为 running
-		c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].State = criapi.ContainerState_CONTAINER_RUNNING
-		c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].Message = "Running"
-		c.notifyC <- struct{}{}
-		// 执行命令
-		cmd := cmd
-		go func() {
-			outMessage, errMessage, err := cmd.Run()
-			// 执行完毕，修改对应的状态
-			// FIXME: 可封装为一个方法
-			if err != nil {
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].State = criapi.ContainerState_CONTAINER_EXITED
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].Reason = "Error"
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].Message = errMessage
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].ExitCode = -9999
-			} else {
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].State = criapi.ContainerState_CONTAINER_EXITED
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].Reason = "Completed"
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].Message = outMessage
-				c.PodManager.samplePodStatus[pod.UID].containers[cmd.ContainerName].ExitCode = 0
-			}
-			c.notifyC <- struct{}{}
-		}()
+	c.notifyStatus(pod)
+	return nil
 
+}
 
+// newSampleContainerStatus 简易pod容器的初始状态
+func newSampleContainerStatus(pod *v1.Pod, cmd *ContainerCmd, reason string) *criapi.ContainerStatus {
+	return &criapi.ContainerStatus{
+		Metadata: &criapi.ContainerMetadata{
+			Name: cmd.ContainerName,
+		},
+		Id:        string(pod.UID) + cmd.ContainerName,
+		CreatedAt: time.Now().UnixNano(),
+		State:     criapi.ContainerState_CONTAINER_CREATED,
+		Reason:    reason,
+		Message:   "Creating",
 	}
+}
 
-	c.notifyStatus(pod)
-	return nil
+// runSamplePod 依次执行init容器的命令，全部成功后再执行应用容器的命令
+func (c *CriProvider) runSamplePod(ctx context.Context, pod *v1.Pod, ps PodStatus, initCmds, cmds []*ContainerCmd) {
+	// init容器失败时，除了restartPolicy为Never都会重新执行
+	initPolicy := v1.RestartPolicyOnFailure
+	if pod.Spec.RestartPolicy == v1.RestartPolicyNever {
+		initPolicy = v1.RestartPolicyNever
+	}
+	for _, cmd := range initCmds {
+		if !c.runSampleContainer(ctx, pod, ps.initContainers[cmd.ContainerName], cmd, initPolicy) {
+			return
+		}
+	}
+	for _, cmd := range cmds {
+		go c.runSampleContainer(ctx, pod, ps.containers[cmd.ContainerName], cmd, pod.Spec.RestartPolicy)
+	}
+}
+
+// runSampleContainer 执行简易pod容器的命令，退出后按照policy与退避时间重新执行，ctx结束时退出。
+// 返回命令最终是否成功退出
+func (c *CriProvider) runSampleContainer(ctx context.Context, pod *v1.Pod, status *criapi.ContainerStatus, cmd *ContainerCmd, policy v1.RestartPolicy) bool {
+	name := cmd.ContainerName
+	key := restartBackOffKey(pod, name)
+	for {
+		if cmd.isTerminating() {
+			return false
+		}
+		// 修改容器状态为 running，状态由其它goroutine读取，修改时需要持有锁
+		cmd.mu.Lock()
+		status.State = criapi.ContainerState_CONTAINER_RUNNING
+		status.Reason = ""
+		status.Message = "Running"
+		status.ExitCode = 0
+		status.StartedAt = time.Now().UnixNano()
+		status.FinishedAt = 0
+		cmd.Waiting = nil
+		cmd.mu.Unlock()
+		c.notifySamplePods()
 
+		outMessage, errMessage, err := cmd.Run()
+		// 执行完毕，修改对应的状态
+		exitCode := int32(cmd.ExitCode)
+		finishedAt := time.Now()
+		cmd.mu.Lock()
+		status.State = criapi.ContainerState_CONTAINER_EXITED
+		status.FinishedAt = finishedAt.UnixNano()
+		status.ExitCode = exitCode
+		if err != nil {
+			status.Reason = "Error"
+			status.Message = errMessage
+		} else {
+			status.Reason = "Completed"
+			status.Message = outMessage
+		}
+		cmd.mu.Unlock()
+		cmd.markExited()
+		// pod已经删除
+		if ctx.Err() != nil || cmd.isTerminating() {
+			return false
+		}
+		c.notifySamplePods()
+		if !shouldRestartContainer(policy, exitCode) {
+			return exitCode == 0
+		}
+
+		if c.restartBackOff.IsInBackOffSince(key, finishedAt) {
+			backOff := c.restartBackOff.Get(key)
+			cmd.mu.Lock()
+			cmd.Waiting = &v1.ContainerStateWaiting{
+				Reason: reasonCrashLoopBackOff,
+				Message: fmt.Sprintf("back-off %s restarting failed container=%s pod=%s_%s(%s)",
+					backOff, name, pod.Name, pod.Namespace, pod.UID),
+			}
+			cmd.mu.Unlock()
+			c.recordEvent(pod, v1.EventTypeWarning, eventBackOff, "Back-off restarting failed container %s", name)
+			c.notifySamplePods()
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(time.Until(finishedAt.Add(backOff))):
+			}
+		}
+		c.restartBackOff.Next(key, finishedAt)
+
+		// 记录上一次运行的状态，新的attempt写入新的日志文件。
+		// Metadata替换而不是修改，上一次的状态与已经取出的快照仍然使用旧的Metadata
+		cmd.mu.Lock()
+		previous := *status
+		cmd.Previous = &previous
+		attempt := cmd.Attempt + 1
+		cmd.renew(ctx, filepath.Join(filepath.Dir(cmd.LogPath), remote.ContainerLogFileName(name, attempt)), attempt)
+		metadata := *status.Metadata
+		metadata.Attempt = attempt
+		status.Metadata = &metadata
+		cmd.mu.Unlock()
+		klog.Infof("restarting command of container %s in pod %s/%s, attempt %d", name, pod.Namespace, pod.Name, attempt)
+	}
 }
 
 func (c *CriProvider) deleteSamplePod(_ context.Context, pod *v1.Pod) error {
-	ps, ok := c.PodManager.samplePodStatus[pod.UID]
+	ps, ok := c.PodManager.getSamplePodRecord(pod.UID)
 	if !ok {
 		return errdefs.NotFoundf("Pod %s not found", pod.UID)
 	}
 
-	ps.status.State = criapi.PodSandboxState_SANDBOX_NOTREADY
-	for _, ss := range ps.containers {
-		ss.State = criapi.ContainerState_CONTAINER_EXITED
+	// 并行停止命令：先发送SIGTERM，超过宽限时间后发送SIGKILL，退出后不再重启
+	gracePeriod := time.Duration(podGracePeriod(pod)) * time.Second
+	var wg sync.WaitGroup
+	for _, cmd := range ps.cmds {
+		wg.Add(1)
+		go func(cmd *ContainerCmd) {
+			defer wg.Done()
+			cmd.terminate(gracePeriod)
+		}(cmd)
 	}
-	delete(c.PodManager.samplePodStatus, pod.UID)
+	wg.Wait()
+	c.stopSupervisor(pod.UID)
+	// 先删除记录，之后的修改不会被状态循环读取到
+	c.PodManager.removeSamplePod(pod.UID)
+	ps.sampleMu.Lock()
+	sandbox := *ps.status
+	sandbox.State = criapi.PodSandboxState_SANDBOX_NOTREADY
+	ps.status = &sandbox
+	for _, statuses := range []map[string]*criapi.ContainerStatus{ps.initContainers, ps.containers} {
+		for _, ss := range statuses {
+			if ss.State != criapi.ContainerState_CONTAINER_EXITED {
+				ss.State = criapi.ContainerState_CONTAINER_EXITED
+				ss.FinishedAt = time.Now().UnixNano()
+			}
+		}
+	}
+	ps.sampleMu.Unlock()
+	// 删除前上报最终状态，容器都为Terminated，sandbox由我们停止，phase由容器状态决定
+	ps.terminating = true
+	final := ps.snapshot()
+	c.notifyStatus(createPodSpecFromCRI(&final, c.nodeName))
+	c.PodManager.removePod(pod.UID)
 	c.notifyStatus(pod)
+	// 最终状态上报后不再读取日志，删除日志目录
+	if err := os.RemoveAll(filepath.Join(c.podLogRoot, string(pod.UID))); err != nil {
+		klog.Error("Remove file err: ", err)
+	}
 	return nil
 }
@@ -0,0 +1,175 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/creack/pty"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+// nsenterNamespaces 使用nsenter进入的namespace，key为/proc/<pid>/ns下的名称，value为nsenter参数
+var nsenterNamespaces = []struct {
+	name string
+	flag string
+}{
+	{name: "mnt", flag: "--mount"},
+	{name: "uts", flag: "--uts"},
+	{name: "ipc", flag: "--ipc"},
+	{name: "net", flag: "--net"},
+	{name: "pid", flag: "--pid"},
+}
+
+// runSampleInContainer 在简易pod的容器中执行命令。
+// 命令使用与ContainerCmd相同的工作目录与环境变量，容器进程处于不同的namespace时，使用nsenter进入
+func runSampleInContainer(ctx context.Context, pod *PodStatus, containerName string, cmd []string, attach api.AttachIO) error {
+	cc, ok := pod.cmds[containerName]
+	if !ok {
+		return errdefs.NotFoundf("container %s in pod %s could not be found", containerName, pod.status.Metadata.Name)
+	}
+	if len(cmd) == 0 {
+		return errdefs.InvalidInput("command cannot be empty")
+	}
+
+	name, args := cmd[0], cmd[1:]
+	if nsArgs := nsenterArgs(cc); len(nsArgs) > 0 {
+		args = append(append(nsArgs, name), args...)
+		name = "nsenter"
+	}
+	ec := exec.CommandContext(ctx, name, args...)
+	ec.Dir = cc.Cmd.Dir
+	ec.Env = cc.Cmd.Env
+
+	var err error
+	if attach.TTY() {
+		err = runWithTTY(ec, attach)
+	} else {
+		err = runWithPipes(ec, attach)
+	}
+	return toExitError(err)
+}
+
+// nsenterArgs 容器进程与当前进程的namespace不同且存在nsenter命令时，返回nsenter的参数
+func nsenterArgs(cc *ContainerCmd) []string {
+	pid := cc.pid
+	if pid == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		return nil
+	}
+	var args []string
+	for _, ns := range nsenterNamespaces {
+		self, err := os.Readlink("/proc/self/ns/" + ns.name)
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name))
+		if err != nil || self == target {
+			continue
+		}
+		args = append(args, ns.flag)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return append([]string{"--target", strconv.Itoa(pid)}, append(args, "--")...)
+}
+
+// runWithPipes 不使用tty执行命令，直接转发标准输入输出
+func runWithPipes(ec *exec.Cmd, attach api.AttachIO) error {
+	ec.Stdout = attach.Stdout()
+	ec.Stderr = attach.Stderr()
+	if stdin := attach.Stdin(); stdin != nil {
+		w, err := ec.StdinPipe()
+		if err != nil {
+			return err
+		}
+		go func() {
+			_, _ = io.Copy(w, stdin)
+			_ = w.Close()
+		}()
+		defer closeStdin(stdin)
+	}
+	return ec.Run()
+}
+
+// runWithTTY 为命令分配pty，并转发终端大小的变化
+func runWithTTY(ec *exec.Cmd, attach api.AttachIO) error {
+	f, err := pty.Start(ec)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	if resize := attach.Resize(); resize != nil {
+		go func() {
+			for {
+				select {
+				case size, ok := <-resize:
+					if !ok {
+						return
+					}
+					if err := pty.Setsize(f, &pty.Winsize{Rows: size.Height, Cols: size.Width}); err != nil {
+						klog.Warningf("resize tty err: %s", err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	if stdin := attach.Stdin(); stdin != nil {
+		go func() {
+			_, _ = io.Copy(f, stdin)
+		}()
+		defer closeStdin(stdin)
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		var stdout io.Writer = io.Discard
+		if out := attach.Stdout(); out != nil {
+			stdout = out
+		}
+		// 命令退出后，读取pty会返回EIO
+		_, _ = io.Copy(stdout, f)
+	}()
+	err = ec.Wait()
+	<-copied
+	return err
+}
+
+// closeStdin 命令退出后关闭标准输入，结束阻塞在读取客户端输入上的拷贝，
+// 否则拷贝的goroutine要等到客户端断开连接才会退出
+func closeStdin(stdin io.Reader) {
+	// 标准输入通常是httpstream.Stream，Close只关闭写端，Reset才能结束阻塞的读取
+	if s, ok := stdin.(interface{ Reset() error }); ok {
+		_ = s.Reset()
+		return
+	}
+	if c, ok := stdin.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// toExitError 把exec.ExitError转换为virtual-kubelet能识别的退出码错误
+func toExitError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return utilexec.CodeExitError{
+			Err:  fmt.Errorf("command terminated with non-zero exit code: %s", exitErr),
+			Code: exitErr.ExitCode(),
+		}
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// hostResolvConf 宿主机的dns配置，dnsPolicy为Default时使用
+	hostResolvConf = "/etc/resolv.conf"
+	// hostHostsFile 宿主机的hosts文件，hostNetwork的pod使用
+	hostHostsFile = "/etc/hosts"
+	// etcHostsFileName pod的hosts文件，挂载到每个容器的/etc/hosts
+	etcHostsFileName = "etc-hosts"
+
+	// 与kubelet一致的dns限制
+	maxDNSNameservers = 3
+	maxDNSSearches    = 6
+	// clusterFirstNdots ClusterFirst时的ndots选项
+	clusterFirstNdots = "ndots:5"
+
+	// eventMissingClusterDNS dnsPolicy为ClusterFirst但是没有配置集群dns
+	eventMissingClusterDNS = "MissingClusterDNS"
+	// eventDNSConfigForming dns配置超过限制被截断
+	eventDNSConfigForming = "DNSConfigForming"
+)
+
+// podDNSConfig 按照dnsPolicy与dnsConfig生成pod的dns配置
+func (c *CriProvider) podDNSConfig(pod *v1.Pod) (*criapi.DNSConfig, error) {
+	policy := pod.Spec.DNSPolicy
+	if policy == "" {
+		policy = v1.DNSClusterFirst
+	}
+	// hostNetwork的pod只有ClusterFirstWithHostNet才使用集群dns
+	if pod.Spec.HostNetwork && policy == v1.DNSClusterFirst {
+		policy = v1.DNSDefault
+	}
+	if policy == v1.DNSClusterFirstWithHostNet {
+		policy = v1.DNSClusterFirst
+	}
+	if policy == v1.DNSClusterFirst && len(c.options.ClusterDNS) == 0 {
+		c.recordEvent(pod, v1.EventTypeWarning, eventMissingClusterDNS,
+			"pod: %q. kubelet does not have ClusterDNS IP configured and cannot create Pod using %q policy. Falling back to %q policy.",
+			pod.Name, v1.DNSClusterFirst, v1.DNSDefault)
+		policy = v1.DNSDefault
+	}
+
+	config := &criapi.DNSConfig{}
+	switch policy {
+	case v1.DNSNone:
+	case v1.DNSDefault:
+		hostConfig, err := parseResolvConf(hostResolvConf)
+		if err != nil {
+			return nil, err
+		}
+		config = hostConfig
+	case v1.DNSClusterFirst:
+		hostConfig, err := parseResolvConf(hostResolvConf)
+		if err != nil {
+			return nil, err
+		}
+		domain := c.options.ClusterDomain
+		config.Servers = append(config.Servers, c.options.ClusterDNS...)
+		if domain != "" {
+			config.Searches = []string{
+				fmt.Sprintf("%s.svc.%s", pod.Namespace, domain),
+				fmt.Sprintf("svc.%s", domain),
+				domain,
+			}
+		}
+		config.Searches = append(config.Searches, hostConfig.Searches...)
+		config.Options = []string{clusterFirstNdots}
+	default:
+		return nil, fmt.Errorf("unsupported dnsPolicy %s", pod.Spec.DNSPolicy)
+	}
+
+	if pod.Spec.DNSConfig != nil {
+		config = appendDNSConfig(config, pod.Spec.DNSConfig)
+	}
+	c.limitDNSConfig(pod, config)
+	return config, nil
+}
+
+// appendDNSConfig 合并pod中的dnsConfig，nameservers与searches去重追加，同名的options覆盖
+func appendDNSConfig(config *criapi.DNSConfig, podConfig *v1.PodDNSConfig) *criapi.DNSConfig {
+	config.Servers = dedup(append(config.Servers, podConfig.Nameservers...))
+	config.Searches = dedup(append(config.Searches, podConfig.Searches...))
+
+	options := make([]string, 0, len(config.Options)+len(podConfig.Options))
+	index := make(map[string]int)
+	add := func(name, option string) {
+		if i, ok := index[name]; ok {
+			options[i] = option
+			return
+		}
+		index[name] = len(options)
+		options = append(options, option)
+	}
+	for _, option := range config.Options {
+		add(strings.SplitN(option, ":", 2)[0], option)
+	}
+	for _, option := range podConfig.Options {
+		if option.Value != nil {
+			add(option.Name, fmt.Sprintf("%s:%s", option.Name, *option.Value))
+		} else {
+			add(option.Name, option.Name)
+		}
+	}
+	config.Options = options
+	return config
+}
+
+// limitDNSConfig nameservers与searches超过限制时截断，并记录事件
+func (c *CriProvider) limitDNSConfig(pod *v1.Pod, config *criapi.DNSConfig) {
+	if len(config.Servers) > maxDNSNameservers {
+		config.Servers = config.Servers[:maxDNSNameservers]
+		c.recordEvent(pod, v1.EventTypeWarning, eventDNSConfigForming,
+			"Nameserver limits were exceeded, some nameservers have been omitted, the applied nameserver line is: %s",
+			strings.Join(config.Servers, " "))
+	}
+	if len(config.Searches) > maxDNSSearches {
+		config.Searches = config.Searches[:maxDNSSearches]
+		c.recordEvent(pod, v1.EventTypeWarning, eventDNSConfigForming,
+			"Search Line limits were exceeded, some search paths have been omitted, the applied search line is: %s",
+			strings.Join(config.Searches, " "))
+	}
+}
+
+// parseResolvConf 解析resolv.conf中的nameserver、search与options，文件不存在时返回空配置
+func parseResolvConf(path string) (*criapi.DNSConfig, error) {
+	config := &criapi.DNSConfig{}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			klog.Warningf("resolv.conf %s not found, use empty dns config", path)
+			return config, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			config.Servers = append(config.Servers, fields[1])
+		case "search":
+			// 只有最后一个search生效
+			config.Searches = fields[1:]
+		case "options":
+			config.Options = append(config.Options, fields[1:]...)
+		}
+	}
+	return config, scanner.Err()
+}
+
+// dedup 去重并保持顺序
+func dedup(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// writeEtcHosts 生成pod的hosts文件，返回文件路径。
+// hostNetwork的pod使用宿主机的hosts文件，其余pod写入pod自己的ip与主机名，并追加hostAliases
+func (c *CriProvider) writeEtcHosts(pod *v1.Pod) (string, error) {
+	var buffer bytes.Buffer
+	if pod.Spec.HostNetwork {
+		hostContent, err := ioutil.ReadFile(hostHostsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		buffer.WriteString("# Kubernetes-managed hosts file (host network).\n")
+		buffer.Write(hostContent)
+	} else {
+		hostname, domain, err := remote.PodHostnameAndDomain(pod, c.options.ClusterDomain)
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString("# Kubernetes-managed hosts file.\n")
+		buffer.WriteString("127.0.0.1\tlocalhost\n")
+		buffer.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		buffer.WriteString("fe00::0\tip6-localnet\n")
+		buffer.WriteString("fe00::0\tip6-mcastprefix\n")
+		buffer.WriteString("fe00::1\tip6-allnodes\n")
+		buffer.WriteString("fe00::2\tip6-allrouters\n")
+		// setHostnameAsFQDN时hostname已经是完整域名
+		shortName := strings.SplitN(hostname, ".", 2)[0]
+		for _, ip := range pod.Status.PodIPs {
+			if domain != "" {
+				buffer.WriteString(fmt.Sprintf("%s\t%s.%s\t%s\n", ip.IP, shortName, domain, shortName))
+			} else {
+				buffer.WriteString(fmt.Sprintf("%s\t%s\n", ip.IP, shortName))
+			}
+		}
+	}
+	if len(pod.Spec.HostAliases) > 0 {
+		buffer.WriteString("\n# Entries added by HostAliases.\n")
+		for _, alias := range pod.Spec.HostAliases {
+			buffer.WriteString(fmt.Sprintf("%s\t%s\n", alias.IP, strings.Join(alias.Hostnames, "\t")))
+		}
+	}
+
+	path := c.etcHostsPath(pod.UID)
+	if err := os.MkdirAll(filepath.Dir(path), PodVolRootPerms); err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// etcHostsPath pod的hosts文件路径
+func (c *CriProvider) etcHostsPath(uid types.UID) string {
+	return filepath.Join(c.podVolRoot, string(uid), etcHostsFileName)
+}
@@ -0,0 +1,90 @@
+package providers
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func TestAppendDNSConfig(t *testing.T) {
+	two := "2"
+	tests := []struct {
+		name      string
+		config    *criapi.DNSConfig
+		podConfig *v1.PodDNSConfig
+		want      *criapi.DNSConfig
+	}{
+		{
+			name:      "empty pod config",
+			config:    &criapi.DNSConfig{Servers: []string{"10.0.0.10"}, Searches: []string{"svc.cluster.local"}, Options: []string{"ndots:5"}},
+			podConfig: &v1.PodDNSConfig{},
+			want:      &criapi.DNSConfig{Servers: []string{"10.0.0.10"}, Searches: []string{"svc.cluster.local"}, Options: []string{"ndots:5"}},
+		},
+		{
+			name:   "append and dedup",
+			config: &criapi.DNSConfig{Servers: []string{"10.0.0.10"}, Searches: []string{"svc.cluster.local"}},
+			podConfig: &v1.PodDNSConfig{
+				Nameservers: []string{"10.0.0.10", "8.8.8.8"},
+				Searches:    []string{"example.com", "svc.cluster.local"},
+			},
+			want: &criapi.DNSConfig{
+				Servers:  []string{"10.0.0.10", "8.8.8.8"},
+				Searches: []string{"svc.cluster.local", "example.com"},
+				Options:  []string{},
+			},
+		},
+		{
+			name:   "override options",
+			config: &criapi.DNSConfig{Options: []string{"ndots:5", "rotate"}},
+			podConfig: &v1.PodDNSConfig{Options: []v1.PodDNSConfigOption{
+				{Name: "ndots", Value: &two},
+				{Name: "edns0"},
+			}},
+			want: &criapi.DNSConfig{Servers: []string{}, Searches: []string{}, Options: []string{"ndots:2", "rotate", "edns0"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appendDNSConfig(tt.config, tt.podConfig)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("appendDNSConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitDNSConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *criapi.DNSConfig
+		want   *criapi.DNSConfig
+	}{
+		{
+			name:   "within limits",
+			config: &criapi.DNSConfig{Servers: []string{"a", "b"}, Searches: []string{"1", "2"}},
+			want:   &criapi.DNSConfig{Servers: []string{"a", "b"}, Searches: []string{"1", "2"}},
+		},
+		{
+			name:   "too many nameservers",
+			config: &criapi.DNSConfig{Servers: []string{"a", "b", "c", "d"}},
+			want:   &criapi.DNSConfig{Servers: []string{"a", "b", "c"}},
+		},
+		{
+			name:   "too many searches",
+			config: &criapi.DNSConfig{Searches: []string{"1", "2", "3", "4", "5", "6", "7"}},
+			want:   &criapi.DNSConfig{Searches: []string{"1", "2", "3", "4", "5", "6"}},
+		},
+	}
+	c := &CriProvider{}
+	pod := &v1.Pod{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.limitDNSConfig(pod, tt.config)
+			if !reflect.DeepEqual(tt.config, tt.want) {
+				t.Errorf("limitDNSConfig() = %+v, want %+v", tt.config, tt.want)
+			}
+		})
+	}
+}
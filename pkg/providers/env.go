@@ -0,0 +1,345 @@
+package providers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// makeEnvironmentVariables 解析容器的环境变量，包括envFrom、valueFrom与$(VAR)引用。
+// 返回的环境变量只包含Value，按名称排序
+func (c *CriProvider) makeEnvironmentVariables(pod *v1.Pod, container *v1.Container) ([]v1.EnvVar, error) {
+	tmpEnv := make(map[string]string)
+
+	// envFrom 先处理，env中的同名变量会覆盖
+	for _, envFrom := range container.EnvFrom {
+		switch {
+		case envFrom.ConfigMapRef != nil:
+			cm := envFrom.ConfigMapRef
+			optional := cm.Optional != nil && *cm.Optional
+			configMap, err := c.getConfigMap(cm.Name, pod.Namespace)
+			if err != nil {
+				if errors.IsNotFound(err) && optional {
+					continue
+				}
+				return nil, err
+			}
+			for k, v := range configMap.Data {
+				addEnvFrom(tmpEnv, envFrom.Prefix+k, v)
+			}
+		case envFrom.SecretRef != nil:
+			s := envFrom.SecretRef
+			optional := s.Optional != nil && *s.Optional
+			secret, err := c.getSecret(s.Name, pod.Namespace)
+			if err != nil {
+				if errors.IsNotFound(err) && optional {
+					continue
+				}
+				return nil, err
+			}
+			for k, v := range secret.Data {
+				addEnvFrom(tmpEnv, envFrom.Prefix+k, string(v))
+			}
+		}
+	}
+
+	for _, envVar := range container.Env {
+		runtimeVal := envVar.Value
+		if runtimeVal != "" {
+			// 可以引用之前定义的变量
+			runtimeVal = expandEnv(runtimeVal, tmpEnv)
+		} else if envVar.ValueFrom != nil {
+			value, ok, err := c.envVarSourceValue(pod, container, envVar.ValueFrom)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't resolve env %s: %v", envVar.Name, err)
+			}
+			// optional的configMap/secret不存在时，不设置此变量
+			if !ok {
+				continue
+			}
+			runtimeVal = value
+		}
+		tmpEnv[envVar.Name] = runtimeVal
+	}
+
+	names := make([]string, 0, len(tmpEnv))
+	for name := range tmpEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]v1.EnvVar, 0, len(names))
+	for _, name := range names {
+		result = append(result, v1.EnvVar{Name: name, Value: tmpEnv[name]})
+	}
+	return result, nil
+}
+
+// addEnvFrom 添加envFrom中的变量，忽略不合法的变量名
+func addEnvFrom(env map[string]string, name, value string) {
+	if errMsgs := validation.IsEnvVarName(name); len(errMsgs) != 0 {
+		klog.Warningf("skip invalid env name %q: %s", name, strings.Join(errMsgs, ","))
+		return
+	}
+	env[name] = value
+}
+
+// envVarSourceValue 解析valueFrom，返回false时表示不设置此变量
+func (c *CriProvider) envVarSourceValue(pod *v1.Pod, container *v1.Container, source *v1.EnvVarSource) (string, bool, error) {
+	switch {
+	case source.FieldRef != nil:
+		value, err := podFieldSelectorRuntimeValue(source.FieldRef, pod)
+		return value, err == nil, err
+	case source.ResourceFieldRef != nil:
+		value, err := containerResourceRuntimeValue(source.ResourceFieldRef, pod, container, c.nodeCapacity())
+		return value, err == nil, err
+	case source.ConfigMapKeyRef != nil:
+		cm := source.ConfigMapKeyRef
+		optional := cm.Optional != nil && *cm.Optional
+		configMap, err := c.getConfigMap(cm.Name, pod.Namespace)
+		if err != nil {
+			if errors.IsNotFound(err) && optional {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		value, ok := configMap.Data[cm.Key]
+		if !ok && !optional {
+			return "", false, fmt.Errorf("couldn't find key %v in ConfigMap %v/%v", cm.Key, pod.Namespace, cm.Name)
+		}
+		return value, ok, nil
+	case source.SecretKeyRef != nil:
+		s := source.SecretKeyRef
+		optional := s.Optional != nil && *s.Optional
+		secret, err := c.getSecret(s.Name, pod.Namespace)
+		if err != nil {
+			if errors.IsNotFound(err) && optional {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		value, ok := secret.Data[s.Key]
+		if !ok && !optional {
+			return "", false, fmt.Errorf("couldn't find key %v in Secret %v/%v", s.Key, pod.Namespace, s.Name)
+		}
+		return string(value), ok, nil
+	}
+	return "", true, nil
+}
+
+// getConfigMap 获取configMap，对象被volumeWatcher监听时使用它的缓存，与volume的更新事件保持一致
+func (c *CriProvider) getConfigMap(name, namespace string) (*v1.ConfigMap, error) {
+	if c.volumeWatcher != nil {
+		if obj, ok := c.volumeWatcher.get("ConfigMap", namespace, name); ok {
+			if obj == nil {
+				return nil, errors.NewNotFound(v1.Resource("configmaps"), name)
+			}
+			return obj.(*v1.ConfigMap), nil
+		}
+	}
+	if c.resourceManager == nil {
+		return nil, fmt.Errorf("resource manager is not configured, couldn't get configMap %s/%s", namespace, name)
+	}
+	return c.resourceManager.GetConfigMap(name, namespace)
+}
+
+// getSecret 获取secret，对象被volumeWatcher监听时使用它的缓存，与volume的更新事件保持一致
+func (c *CriProvider) getSecret(name, namespace string) (*v1.Secret, error) {
+	if c.volumeWatcher != nil {
+		if obj, ok := c.volumeWatcher.get("Secret", namespace, name); ok {
+			if obj == nil {
+				return nil, errors.NewNotFound(v1.Resource("secrets"), name)
+			}
+			return obj.(*v1.Secret), nil
+		}
+	}
+	if c.resourceManager == nil {
+		return nil, fmt.Errorf("resource manager is not configured, couldn't get secret %s/%s", namespace, name)
+	}
+	return c.resourceManager.GetSecret(name, namespace)
+}
+
+// nodeCapacity 节点资源，容器没有设置limits时作为默认值
+func (c *CriProvider) nodeCapacity() v1.ResourceList {
+	return nodeCapacity(c.options.ResourceCPU, c.options.ResourceMemory, c.options.MaxPod)
+}
+
+// podFieldSelectorRuntimeValue 解析fieldRef，支持metadata与spec.nodeName、status.podIP等字段
+func podFieldSelectorRuntimeValue(fs *v1.ObjectFieldSelector, pod *v1.Pod) (string, error) {
+	switch fs.FieldPath {
+	case "spec.nodeName":
+		return pod.Spec.NodeName, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
+	case "status.podIPs":
+		ips := make([]string, 0, len(pod.Status.PodIPs))
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		return strings.Join(ips, ","), nil
+	}
+	return extractFieldPathAsString(pod, fs.FieldPath)
+}
+
+// extractFieldPathAsString 解析pod metadata中的字段，与downward API支持的字段一致
+func extractFieldPathAsString(pod *v1.Pod, fieldPath string) (string, error) {
+	if path, subscript, ok := splitMaybeSubscriptedPath(fieldPath); ok {
+		switch path {
+		case "metadata.annotations":
+			return pod.Annotations[subscript], nil
+		case "metadata.labels":
+			return pod.Labels[subscript], nil
+		default:
+			return "", fmt.Errorf("fieldPath %q does not support subscript", fieldPath)
+		}
+	}
+
+	switch fieldPath {
+	case "metadata.annotations":
+		return formatMap(pod.Annotations), nil
+	case "metadata.labels":
+		return formatMap(pod.Labels), nil
+	case "metadata.name":
+		return pod.Name, nil
+	case "metadata.namespace":
+		return pod.Namespace, nil
+	case "metadata.uid":
+		return string(pod.UID), nil
+	}
+	return "", fmt.Errorf("unsupported fieldPath: %v", fieldPath)
+}
+
+// splitMaybeSubscriptedPath 解析 metadata.labels['key'] 形式的路径
+func splitMaybeSubscriptedPath(fieldPath string) (string, string, bool) {
+	if !strings.HasSuffix(fieldPath, "']") {
+		return fieldPath, "", false
+	}
+	s := strings.TrimSuffix(fieldPath, "']")
+	parts := strings.SplitN(s, "['", 2)
+	if len(parts) < 2 || len(parts[0]) == 0 {
+		return fieldPath, "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// formatMap 把map格式化为 key="value" 的多行文本，按key排序
+func formatMap(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(fmt.Sprintf("%v=%q\n", k, m[k]))
+	}
+	return b.String()
+}
+
+// containerResourceRuntimeValue 解析resourceFieldRef，limits没有设置时使用节点资源
+func containerResourceRuntimeValue(fs *v1.ResourceFieldSelector, pod *v1.Pod, container *v1.Container, nodeCapacity v1.ResourceList) (string, error) {
+	target := container
+	if fs.ContainerName != "" {
+		target = nil
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].Name == fs.ContainerName {
+				target = &pod.Spec.Containers[i]
+				break
+			}
+		}
+		if target == nil {
+			return "", fmt.Errorf("container %s not found in pod %s", fs.ContainerName, pod.Name)
+		}
+	}
+
+	divisor := fs.Divisor
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+
+	var (
+		quantity resource.Quantity
+		name     v1.ResourceName
+	)
+	switch fs.Resource {
+	case "limits.cpu", "limits.memory", "limits.ephemeral-storage":
+		name = v1.ResourceName(strings.TrimPrefix(fs.Resource, "limits."))
+		q, ok := target.Resources.Limits[name]
+		if !ok || q.IsZero() {
+			q = nodeCapacity[name]
+		}
+		quantity = q
+	case "requests.cpu", "requests.memory", "requests.ephemeral-storage":
+		name = v1.ResourceName(strings.TrimPrefix(fs.Resource, "requests."))
+		quantity = target.Resources.Requests[name]
+	default:
+		return "", fmt.Errorf("unsupported container resource: %v", fs.Resource)
+	}
+
+	if name == v1.ResourceCPU {
+		// cpu以milli为单位计算，向上取整
+		value := int64(math.Ceil(float64(quantity.MilliValue()) / float64(divisor.MilliValue())))
+		return fmt.Sprintf("%d", value), nil
+	}
+	value := int64(math.Ceil(float64(quantity.Value()) / float64(divisor.Value())))
+	return fmt.Sprintf("%d", value), nil
+}
+
+// expandEnv 按照k8s的规则展开$(VAR_NAME)：$$转义为$，未定义的变量保持原样
+func expandEnv(input string, env map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(input); i++ {
+		if input[i] == '$' && i+1 < len(input) {
+			switch input[i+1] {
+			case '$':
+				b.WriteByte('$')
+				i++
+				continue
+			case '(':
+				end := strings.IndexByte(input[i+2:], ')')
+				if end >= 0 {
+					name := input[i+2 : i+2+end]
+					if value, ok := env[name]; ok {
+						b.WriteString(value)
+					} else {
+						b.WriteString(input[i : i+3+end])
+					}
+					i += 2 + end
+					continue
+				}
+			}
+		}
+		b.WriteByte(input[i])
+	}
+	return b.String()
+}
+
+// expandContainerCommand 展开command与args中引用的环境变量
+func expandContainerCommand(container *v1.Container, envs []v1.EnvVar) {
+	env := make(map[string]string, len(envs))
+	for _, e := range envs {
+		env[e.Name] = e.Value
+	}
+	expand := func(in []string) []string {
+		if in == nil {
+			return nil
+		}
+		out := make([]string, 0, len(in))
+		for _, s := range in {
+			out = append(out, expandEnv(s, env))
+		}
+		return out
+	}
+	container.Command = expand(container.Command)
+	container.Args = expand(container.Args)
+}
@@ -0,0 +1,28 @@
+package providers
+
+import "testing"
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"FOO": "foo", "BAR": "bar", "EMPTY": ""}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "", want: ""},
+		{input: "plain", want: "plain"},
+		{input: "$(FOO)", want: "foo"},
+		{input: "$(FOO)-$(BAR)", want: "foo-bar"},
+		{input: "a$(EMPTY)b", want: "ab"},
+		{input: "$(UNDEFINED)", want: "$(UNDEFINED)"},
+		{input: "$$(FOO)", want: "$(FOO)"},
+		{input: "$$$(FOO)", want: "$foo"},
+		{input: "$(FOO", want: "$(FOO"},
+		{input: "$FOO", want: "$FOO"},
+		{input: "cost $", want: "cost $"},
+	}
+	for _, tt := range tests {
+		if got := expandEnv(tt.input, env); got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
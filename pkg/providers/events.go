@@ -0,0 +1,44 @@
+package providers
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// 事件的reason，与kubelet保持一致
+const (
+	// eventSysctlForbidden pod中的sysctl不被允许
+	eventSysctlForbidden = "SysctlForbidden"
+	// eventSecurityContextForbidden pod中的securityContext在本节点上无法生效
+	eventSecurityContextForbidden = "SecurityContextForbidden"
+	// eventFailed 容器创建失败
+	eventFailed = "Failed"
+	// eventFailedMount pod的volume无法挂载
+	eventFailedMount = "FailedMount"
+	// eventFailedCreatePodContainer pod创建失败，已经创建的容器与sandbox被回滚
+	eventFailedCreatePodContainer = "FailedCreatePodContainer"
+)
+
+// eventComponent 事件的来源组件
+const eventComponent = "virtual-kubelet"
+
+// newEventRecorder 创建事件记录器，事件上报到对象所在的namespace
+func newEventRecorder(client kubernetes.Interface, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent, Host: nodeName})
+}
+
+// recordEvent 记录pod的事件，没有k8s客户端时只打印日志
+func (c *CriProvider) recordEvent(pod *v1.Pod, eventType, reason, messageFmt string, args ...interface{}) {
+	if c.eventRecorder == nil {
+		klog.Infof("pod %s/%s event %s: "+messageFmt, append([]interface{}{pod.Namespace, pod.Name, reason}, args...)...)
+		return
+	}
+	c.eventRecorder.Eventf(pod, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,171 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/remotecommand"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	utilexec "k8s.io/utils/exec"
+)
+
+// runInContainer 在容器中执行命令(kubectl exec)
+func (c *CriProvider) runInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
+	// 刷新node中pod状态
+	err := c.refreshNodeState(ctx)
+	if err != nil {
+		return err
+	}
+	pod := c.findPodByName(namespace, podName)
+	if pod == nil {
+		return errdefs.NotFoundf("pod %s in namespace %s could not be found on the node", podName, namespace)
+	}
+	cs, ok := pod.containers[containerName]
+	if !ok {
+		return errdefs.NotFoundf("container %s in pod %s could not be found", containerName, podName)
+	}
+	if cs.State != criapi.ContainerState_CONTAINER_RUNNING {
+		return errdefs.InvalidInputf("container %s in pod %s is not running", containerName, podName)
+	}
+	// 简易pod直接在本机执行命令
+	if c.PodManager.isSamplePod(types.UID(pod.status.Metadata.Uid)) {
+		return runSampleInContainer(ctx, pod, containerName, cmd, attach)
+	}
+
+	// 没有attach任何输入输出时，CRI不允许流式执行，直接同步执行只返回退出码。
+	// 只要有输出就走streaming，避免ExecSync在命令退出前缓存全部输出(如tail -f)
+	if attach.Stdin() == nil && attach.Stdout() == nil && attach.Stderr() == nil {
+		return c.execSync(ctx, cs.Id, cmd, attach)
+	}
+
+	url, err := remote.Exec(ctx, c.remoteCRI.RuntimeService, &criapi.ExecRequest{
+		ContainerId: cs.Id,
+		Cmd:         cmd,
+		Tty:         attach.TTY(),
+		Stdin:       attach.Stdin() != nil,
+		Stdout:      attach.Stdout() != nil,
+		Stderr:      attach.Stderr() != nil,
+	})
+	if err != nil {
+		return err
+	}
+	return remote.StreamURL(url, newStreamOptions(ctx, attach))
+}
+
+// attachToContainer 准备attach到正在运行的容器(kubectl attach)，返回CRI streaming server的url，
+// 容器需要以Stdin/Tty方式创建
+func (c *CriProvider) attachToContainer(ctx context.Context, namespace, podName, containerName string, opts StreamOptions) (string, error) {
+	// 刷新node中pod状态
+	err := c.refreshNodeState(ctx)
+	if err != nil {
+		return "", err
+	}
+	pod := c.findPodByName(namespace, podName)
+	if pod == nil {
+		return "", errdefs.NotFoundf("pod %s in namespace %s could not be found on the node", podName, namespace)
+	}
+	if c.PodManager.isSamplePod(types.UID(pod.status.Metadata.Uid)) {
+		return "", errdefs.InvalidInputf("attach is not supported for bash pod %s", podName)
+	}
+	cs, ok := pod.containers[containerName]
+	if !ok {
+		return "", errdefs.NotFoundf("container %s in pod %s could not be found", containerName, podName)
+	}
+	if cs.State != criapi.ContainerState_CONTAINER_RUNNING {
+		return "", errdefs.InvalidInputf("container %s in pod %s is not running", containerName, podName)
+	}
+
+	return remote.Attach(ctx, c.remoteCRI.RuntimeService, &criapi.AttachRequest{
+		ContainerId: cs.Id,
+		Tty:         opts.TTY,
+		Stdin:       opts.Stdin,
+		Stdout:      opts.Stdout,
+		Stderr:      opts.Stderr,
+	})
+}
+
+// portForward 准备转发pod sandbox的端口(kubectl port-forward)，返回CRI streaming server的url
+func (c *CriProvider) portForward(ctx context.Context, namespace, podName string) (string, error) {
+	// 刷新node中pod状态
+	err := c.refreshNodeState(ctx)
+	if err != nil {
+		return "", err
+	}
+	pod := c.findPodByName(namespace, podName)
+	if pod == nil {
+		return "", errdefs.NotFoundf("pod %s in namespace %s could not be found on the node", podName, namespace)
+	}
+	// 简易pod没有sandbox，进程直接运行在本机网络中
+	if c.PodManager.isSamplePod(types.UID(pod.status.Metadata.Uid)) {
+		return "", errdefs.InvalidInputf("port-forward is not supported for bash pod %s", podName)
+	}
+	return remote.PortForward(ctx, c.remoteCRI.RuntimeService, pod.id)
+}
+
+// execSync 使用ExecSync执行命令，并把输出写回attach
+func (c *CriProvider) execSync(ctx context.Context, cId string, cmd []string, attach api.AttachIO) error {
+	r, err := remote.ExecSync(ctx, c.remoteCRI.RuntimeService, cId, cmd, 0)
+	if err != nil {
+		return err
+	}
+	if err = writeOutput(attach.Stdout(), r.Stdout); err != nil {
+		return err
+	}
+	if err = writeOutput(attach.Stderr(), r.Stderr); err != nil {
+		return err
+	}
+	if r.ExitCode != 0 {
+		// virtual-kubelet 根据 ExitError 把退出码返回给客户端
+		return utilexec.CodeExitError{
+			Err:  fmt.Errorf("command terminated with non-zero exit code: %d", r.ExitCode),
+			Code: int(r.ExitCode),
+		}
+	}
+	return nil
+}
+
+func writeOutput(w io.Writer, b []byte) error {
+	if w == nil || len(b) == 0 {
+		return nil
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// newStreamOptions 由api.AttachIO生成streaming请求的配置
+func newStreamOptions(ctx context.Context, attach api.AttachIO) remotecommand.StreamOptions {
+	opts := remotecommand.StreamOptions{
+		Stdin:  attach.Stdin(),
+		Stdout: attach.Stdout(),
+		Stderr: attach.Stderr(),
+		Tty:    attach.TTY(),
+	}
+	if attach.TTY() && attach.Resize() != nil {
+		opts.TerminalSizeQueue = &termSizeQueue{ctx: ctx, resize: attach.Resize()}
+	}
+	return opts
+}
+
+// termSizeQueue 把api.AttachIO中的终端大小变化转发给streaming server
+type termSizeQueue struct {
+	ctx    context.Context
+	resize <-chan api.TermSize
+}
+
+// Next 返回下一个终端大小，返回nil时停止转发
+func (q *termSizeQueue) Next() *remotecommand.TerminalSize {
+	select {
+	case size, ok := <-q.resize:
+		if !ok {
+			return nil
+		}
+		return &remotecommand.TerminalSize{Width: size.Width, Height: size.Height}
+	case <-q.ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// eventHostPortConflict pod申请的hostPort已经被占用
+	eventHostPortConflict = "HostPortConflict"
+	// hostPortsAnnotation sandbox上记录的hostPort，重启后用于恢复预留
+	hostPortsAnnotation = "virtual-kubelet.io/host-ports"
+)
+
+// hostPort 宿主机上的端口
+type hostPort struct {
+	protocol v1.Protocol
+	hostIP   string
+	port     int32
+}
+
+// hostPortReservation pod预留的hostPort
+type hostPortReservation struct {
+	// pod namespace/name，用于冲突时的提示
+	pod   string
+	ports []hostPort
+}
+
+func (p hostPort) String() string {
+	ip := p.hostIP
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(ip, strconv.Itoa(int(p.port))), p.protocol)
+}
+
+// conflicts 协议与端口相同，并且有一方监听所有地址或者地址相同时冲突
+func (p hostPort) conflicts(other hostPort) bool {
+	if p.protocol != other.protocol || p.port != other.port {
+		return false
+	}
+	return isWildcardIP(p.hostIP) || isWildcardIP(other.hostIP) || p.hostIP == other.hostIP
+}
+
+func isWildcardIP(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || ip == "::"
+}
+
+// podHostPorts pod申请的hostPort，hostNetwork的pod中containerPort即为hostPort
+func podHostPorts(pod *v1.Pod) []hostPort {
+	var ports []hostPort
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, p := range c.Ports {
+				port := p.HostPort
+				if pod.Spec.HostNetwork && port == 0 {
+					port = p.ContainerPort
+				}
+				if port == 0 {
+					continue
+				}
+				protocol := p.Protocol
+				if protocol == "" {
+					protocol = v1.ProtocolTCP
+				}
+				ports = append(ports, hostPort{protocol: protocol, hostIP: p.HostIP, port: port})
+			}
+		}
+	}
+	return ports
+}
+
+// encodeHostPorts 把hostPort编码为sandbox的annotation，格式为逗号分隔的ip:port/protocol
+func encodeHostPorts(ports []hostPort) string {
+	values := make([]string, 0, len(ports))
+	for _, port := range ports {
+		values = append(values, port.String())
+	}
+	return strings.Join(values, ",")
+}
+
+// decodeHostPorts 解析sandbox的hostPort annotation
+func decodeHostPorts(value string) ([]hostPort, error) {
+	var ports []hostPort
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid host port %q", item)
+		}
+		host, portStr, err := net.SplitHostPort(item[:i])
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseInt(portStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if host == "0.0.0.0" {
+			host = ""
+		}
+		ports = append(ports, hostPort{protocol: v1.Protocol(item[i+1:]), hostIP: host, port: int32(port)})
+	}
+	return ports, nil
+}
+
+// reserveHostPorts 检查pod申请的hostPort是否与本节点其他pod冲突，或者已经被宿主机上的进程占用。
+// 没有冲突时记录预留，之后创建的pod会与它比较。
+// 通过CNI portmap转发的端口不会被监听，只能通过预留记录发现冲突
+func (c *CriProvider) reserveHostPorts(pod *v1.Pod) error {
+	c.hostPortLock.Lock()
+	defer c.hostPortLock.Unlock()
+
+	ports := podHostPorts(pod)
+	for uid, other := range c.hostPorts {
+		if uid == pod.UID {
+			continue
+		}
+		for _, used := range other.ports {
+			for _, port := range ports {
+				if port.conflicts(used) {
+					return errdefs.InvalidInputf("hostPort %s is already allocated by pod %s", port, other.pod)
+				}
+			}
+		}
+	}
+	for _, port := range ports {
+		if err := probeHostPort(port); err != nil {
+			return errdefs.InvalidInputf("hostPort %s is already in use on the node: %v", port, err)
+		}
+	}
+	if len(ports) > 0 {
+		c.hostPorts[pod.UID] = hostPortReservation{pod: pod.Namespace + "/" + pod.Name, ports: ports}
+	}
+	return nil
+}
+
+// releaseHostPorts 删除pod的hostPort预留
+func (c *CriProvider) releaseHostPorts(uid types.UID) {
+	c.hostPortLock.Lock()
+	defer c.hostPortLock.Unlock()
+	delete(c.hostPorts, uid)
+}
+
+// restoreHostPorts 重启后由运行中的sandbox恢复hostPort预留，
+// 端口来自sandbox的annotation，接管的sandbox没有annotation时使用apiserver中的pod
+func (c *CriProvider) restoreHostPorts(ctx context.Context) error {
+	sandboxes, err := c.listOwnedSandboxes(ctx)
+	if err != nil {
+		return err
+	}
+	apiPods := make(map[string]*v1.Pod)
+	if c.resourceManager != nil {
+		for _, pod := range c.resourceManager.GetPods() {
+			apiPods[string(pod.UID)] = pod
+		}
+	}
+	c.hostPortLock.Lock()
+	defer c.hostPortLock.Unlock()
+	for _, sandbox := range sandboxes {
+		if sandbox.State != criapi.PodSandboxState_SANDBOX_READY || sandbox.Metadata == nil {
+			continue
+		}
+		var ports []hostPort
+		if value, ok := sandbox.Annotations[hostPortsAnnotation]; ok {
+			ports, err = decodeHostPorts(value)
+			if err != nil {
+				klog.Errorf("decode host ports of sandbox %s err: %s", sandbox.Id, err)
+				continue
+			}
+		} else if pod, ok := apiPods[sandbox.Metadata.Uid]; ok {
+			ports = podHostPorts(pod)
+		}
+		if len(ports) > 0 {
+			c.hostPorts[types.UID(sandbox.Metadata.Uid)] = hostPortReservation{
+				pod:   sandbox.Metadata.Namespace + "/" + sandbox.Metadata.Name,
+				ports: ports,
+			}
+		}
+	}
+	return nil
+}
+
+// probeHostPort 尝试监听端口，判断是否被宿主机上的进程占用
+func probeHostPort(port hostPort) error {
+	address := net.JoinHostPort(port.hostIP, strconv.Itoa(int(port.port)))
+	switch port.protocol {
+	case v1.ProtocolTCP:
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		return l.Close()
+	case v1.ProtocolUDP:
+		l, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return err
+		}
+		return l.Close()
+	}
+	// SCTP无法通过标准库检查
+	return nil
+}
@@ -0,0 +1,109 @@
+package providers
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestPodHostPorts(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *v1.Pod
+		want []hostPort
+	}{
+		{
+			name: "no host ports",
+			pod:  &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 80}}}}}},
+		},
+		{
+			name: "host ports of all containers",
+			pod: &v1.Pod{Spec: v1.PodSpec{
+				InitContainers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 80, HostPort: 8080}}}},
+				Containers:     []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 53, HostPort: 53, Protocol: v1.ProtocolUDP, HostIP: "127.0.0.1"}}}},
+			}},
+			want: []hostPort{
+				{protocol: v1.ProtocolTCP, port: 8080},
+				{protocol: v1.ProtocolUDP, hostIP: "127.0.0.1", port: 53},
+			},
+		},
+		{
+			name: "host network",
+			pod: &v1.Pod{Spec: v1.PodSpec{
+				HostNetwork: true,
+				Containers:  []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 80}}}},
+			}},
+			want: []hostPort{{protocol: v1.ProtocolTCP, port: 80}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podHostPorts(tt.pod); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podHostPorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostPortConflicts(t *testing.T) {
+	tests := []struct {
+		a, b hostPort
+		want bool
+	}{
+		{a: hostPort{protocol: v1.ProtocolTCP, port: 80}, b: hostPort{protocol: v1.ProtocolTCP, port: 80}, want: true},
+		{a: hostPort{protocol: v1.ProtocolTCP, port: 80}, b: hostPort{protocol: v1.ProtocolUDP, port: 80}, want: false},
+		{a: hostPort{protocol: v1.ProtocolTCP, port: 80}, b: hostPort{protocol: v1.ProtocolTCP, port: 81}, want: false},
+		{a: hostPort{protocol: v1.ProtocolTCP, port: 80}, b: hostPort{protocol: v1.ProtocolTCP, hostIP: "10.0.0.1", port: 80}, want: true},
+		{a: hostPort{protocol: v1.ProtocolTCP, hostIP: "10.0.0.1", port: 80}, b: hostPort{protocol: v1.ProtocolTCP, hostIP: "10.0.0.2", port: 80}, want: false},
+		{a: hostPort{protocol: v1.ProtocolTCP, hostIP: "::", port: 80}, b: hostPort{protocol: v1.ProtocolTCP, hostIP: "10.0.0.2", port: 80}, want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.a.conflicts(tt.b); got != tt.want {
+			t.Errorf("%s conflicts %s = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestHostPortsAnnotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   []hostPort
+		encoded string
+	}{
+		{name: "empty", encoded: ""},
+		{
+			name: "ipv4 and wildcard",
+			ports: []hostPort{
+				{protocol: v1.ProtocolTCP, port: 8080},
+				{protocol: v1.ProtocolUDP, hostIP: "127.0.0.1", port: 53},
+			},
+			encoded: "0.0.0.0:8080/TCP,127.0.0.1:53/UDP",
+		},
+		{
+			name:    "ipv6",
+			ports:   []hostPort{{protocol: v1.ProtocolSCTP, hostIP: "::1", port: 9000}},
+			encoded: "[::1]:9000/SCTP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeHostPorts(tt.ports); got != tt.encoded {
+				t.Errorf("encodeHostPorts() = %q, want %q", got, tt.encoded)
+			}
+			got, err := decodeHostPorts(tt.encoded)
+			if err != nil {
+				t.Fatalf("decodeHostPorts() err = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.ports) {
+				t.Errorf("decodeHostPorts() = %v, want %v", got, tt.ports)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"8080/TCP", "0.0.0.0:8080", "0.0.0.0:http/TCP"} {
+		if _, err := decodeHostPorts(invalid); err == nil {
+			t.Errorf("decodeHostPorts(%q) should fail", invalid)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// 与kubelet一致，拉取失败后的退避时间从10s开始翻倍，最长5分钟
+	imagePullBackOffInitial = 10 * time.Second
+	imagePullBackOffMax     = 300 * time.Second
+
+	// 与kubelet一致的等待原因
+	reasonContainerCreating = "ContainerCreating"
+	reasonErrImagePull      = "ErrImagePull"
+	reasonImagePullBackOff  = "ImagePullBackOff"
+	reasonErrImageNeverPull = "ErrImageNeverPull"
+
+	// eventPulling 开始拉取镜像
+	eventPulling = "Pulling"
+	// eventPulled 镜像拉取成功或已经存在
+	eventPulled = "Pulled"
+)
+
+// imagePull 一次正在进行的镜像拉取，同一镜像的并发请求共用
+type imagePull struct {
+	done  chan struct{}
+	start time.Time
+	ref   string
+	err   error
+	// duration 拉取耗时，done关闭后有效
+	duration time.Duration
+}
+
+// imageManager 管理镜像拉取，镜像在后台拉取，拉取期间容器处于ContainerCreating
+type imageManager struct {
+	mu sync.Mutex
+	// pulls 正在拉取的镜像
+	pulls map[string]*imagePull
+	// waiters pod中的容器正在等待的拉取，key与退避记录相同
+	waiters map[string]*imagePull
+	// backOff 拉取失败的退避记录
+	backOff *flowcontrol.Backoff
+}
+
+// imagePullError 镜像还不能使用，容器以error中的原因等待，由supervisor稍后重试
+type imagePullError struct {
+	reason  string
+	message string
+}
+
+func (e *imagePullError) Error() string {
+	return e.message
+}
+
+// newImageManager 创建镜像管理器
+func newImageManager() *imageManager {
+	return &imageManager{
+		pulls:   map[string]*imagePull{},
+		waiters: map[string]*imagePull{},
+		backOff: flowcontrol.NewBackOff(imagePullBackOffInitial, imagePullBackOffMax),
+	}
+}
+
+// imagePullBackOffKey 镜像拉取退避的key，与kubelet一致按pod与镜像区分
+func imagePullBackOffKey(pod *v1.Pod, container *v1.Container) string {
+	return fmt.Sprintf("%s_%s_%s", pod.UID, container.Name, container.Image)
+}
+
+// imagePullPolicy 容器的imagePullPolicy，没有设置时与apiserver的默认值一致：
+// 镜像没有tag或tag为latest时为Always，否则为IfNotPresent
+func imagePullPolicy(container *v1.Container) v1.PullPolicy {
+	if container.ImagePullPolicy != "" {
+		return container.ImagePullPolicy
+	}
+	image := container.Image
+	if strings.Contains(image, "@") {
+		return v1.PullIfNotPresent
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i < 0 || name[i+1:] == "latest" {
+		return v1.PullAlways
+	}
+	return v1.PullIfNotPresent
+}
+
+// containerWaitingForError 容器创建失败时的等待原因，镜像不能使用或volume无法挂载时仍处于ContainerCreating
+func containerWaitingForError(err error) *v1.ContainerStateWaiting {
+	switch e := err.(type) {
+	case *imagePullError:
+		return &v1.ContainerStateWaiting{Reason: e.reason, Message: e.message}
+	case *volumeMountError:
+		return &v1.ContainerStateWaiting{Reason: reasonContainerCreating, Message: e.message}
+	}
+	return &v1.ContainerStateWaiting{Reason: "CreateContainerError", Message: err.Error()}
+}
+
+// isContainerWaitingError 容器暂时不能创建，创建pod时不回滚，由supervisor稍后重试
+func isContainerWaitingError(err error) bool {
+	switch err.(type) {
+	case *imagePullError, *volumeMountError:
+		return true
+	}
+	return false
+}
+
+// ensureImageExists 按照imagePullPolicy确保镜像存在，返回镜像的引用。
+// 需要拉取时在后台拉取并返回imagePullError，拉取完成后再次调用得到结果
+func (c *CriProvider) ensureImageExists(ctx context.Context, pod *v1.Pod, container *v1.Container) (string, error) {
+	m := c.images
+	key := imagePullBackOffKey(pod, container)
+
+	// 先处理正在等待的拉取
+	m.mu.Lock()
+	pull, waiting := m.waiters[key]
+	m.mu.Unlock()
+	if waiting {
+		select {
+		case <-pull.done:
+		default:
+			// CRI的PullImage不返回进度，只能报告已经拉取的时间
+			return "", &imagePullError{reason: reasonContainerCreating,
+				message: fmt.Sprintf("Pulling image %q, %s elapsed", container.Image, time.Since(pull.start).Round(time.Second))}
+		}
+		m.mu.Lock()
+		delete(m.waiters, key)
+		m.mu.Unlock()
+		if pull.err != nil {
+			m.backOff.Next(key, m.backOff.Clock.Now())
+			c.recordEvent(pod, v1.EventTypeWarning, eventFailed, "Failed to pull image %q: %v", container.Image, pull.err)
+			return "", &imagePullError{reason: reasonErrImagePull, message: pull.err.Error()}
+		}
+		m.backOff.GC()
+		c.recordEvent(pod, v1.EventTypeNormal, eventPulled, "Successfully pulled image %q in %v", container.Image, pull.duration)
+		return pull.ref, nil
+	}
+
+	policy := imagePullPolicy(container)
+	if policy != v1.PullAlways {
+		image, err := remote.ImageStatus(ctx, c.remoteCRI.ImageService, container.Image)
+		if err != nil {
+			klog.Error("ImageStatus err: ", err)
+			return "", &imagePullError{reason: reasonErrImagePull, message: fmt.Sprintf("Failed to inspect image %q: %v", container.Image, err)}
+		}
+		if image != nil {
+			c.recordEvent(pod, v1.EventTypeNormal, eventPulled, "Container image %q already present on machine", container.Image)
+			return image.Id, nil
+		}
+		if policy == v1.PullNever {
+			message := fmt.Sprintf("Container image %q is not present with pull policy of Never", container.Image)
+			c.recordEvent(pod, v1.EventTypeWarning, reasonErrImageNeverPull, "%s", message)
+			return "", &imagePullError{reason: reasonErrImageNeverPull, message: message}
+		}
+	}
+
+	if m.backOff.IsInBackOffSinceUpdate(key, m.backOff.Clock.Now()) {
+		message := fmt.Sprintf("Back-off pulling image %q", container.Image)
+		c.recordEvent(pod, v1.EventTypeNormal, eventBackOff, "%s", message)
+		return "", &imagePullError{reason: reasonImagePullBackOff, message: message}
+	}
+
+	c.recordEvent(pod, v1.EventTypeNormal, eventPulling, "Pulling image %q", container.Image)
+	m.mu.Lock()
+	m.waiters[key] = c.startImagePull(container.Image)
+	m.mu.Unlock()
+	return "", &imagePullError{reason: reasonContainerCreating, message: fmt.Sprintf("Pulling image %q", container.Image)}
+}
+
+// startImagePull 在后台拉取镜像，同一镜像正在拉取时返回已有的拉取，调用时需要持有m.mu
+func (c *CriProvider) startImagePull(image string) *imagePull {
+	m := c.images
+	if pull, ok := m.pulls[image]; ok {
+		return pull
+	}
+	pull := &imagePull{done: make(chan struct{}), start: time.Now()}
+	m.pulls[image] = pull
+	go func() {
+		klog.Infof("Pulling image %s", image)
+		// 拉取不随创建请求结束，完成后由supervisor使用结果
+		pull.ref, pull.err = remote.PullImage(context.Background(), c.remoteCRI.ImageService, image)
+		pull.duration = time.Since(pull.start)
+		if pull.err != nil {
+			klog.Errorf("PullImage %s err: %s", image, pull.err)
+		}
+		m.mu.Lock()
+		delete(m.pulls, image)
+		m.mu.Unlock()
+		close(pull.done)
+	}()
+	return pull
+}
+
+// forgetImagePulls 删除pod中容器的拉取等待与退避记录
+func (c *CriProvider) forgetImagePulls(pod *v1.Pod) {
+	m := c.images
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			key := imagePullBackOffKey(pod, &containers[i])
+			delete(m.waiters, key)
+			m.backOff.DeleteEntry(key)
+		}
+	}
+}
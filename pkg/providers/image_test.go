@@ -0,0 +1,30 @@
+package providers
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		image  string
+		policy v1.PullPolicy
+		want   v1.PullPolicy
+	}{
+		{image: "nginx", want: v1.PullAlways},
+		{image: "nginx:latest", want: v1.PullAlways},
+		{image: "nginx:1.21", want: v1.PullIfNotPresent},
+		{image: "registry:5000/nginx", want: v1.PullAlways},
+		{image: "registry:5000/nginx:1.21", want: v1.PullIfNotPresent},
+		{image: "nginx@sha256:0123456789abcdef", want: v1.PullIfNotPresent},
+		{image: "nginx:latest", policy: v1.PullNever, want: v1.PullNever},
+		{image: "nginx:1.21", policy: v1.PullAlways, want: v1.PullAlways},
+	}
+	for _, tt := range tests {
+		container := &v1.Container{Image: tt.image, ImagePullPolicy: tt.policy}
+		if got := imagePullPolicy(container); got != tt.want {
+			t.Errorf("imagePullPolicy(%q, %q) = %s, want %s", tt.image, tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultTerminationGracePeriod 与kubelet一致，pod中没有设置terminationGracePeriodSeconds时的宽限时间
+	defaultTerminationGracePeriod = 30
+	// minimumGracePeriod preStop执行后至少留给StopContainer的宽限时间
+	minimumGracePeriod = 2
+
+	// eventFailedPostStartHook postStart执行失败
+	eventFailedPostStartHook = "FailedPostStartHook"
+	// eventFailedPreStopHook preStop执行失败
+	eventFailedPreStopHook = "FailedPreStopHook"
+)
+
+// podGracePeriod 停止容器的宽限时间，pod删除时优先使用deletionGracePeriodSeconds，
+// 否则使用terminationGracePeriodSeconds
+func podGracePeriod(pod *v1.Pod) int64 {
+	if pod.DeletionGracePeriodSeconds != nil {
+		return *pod.DeletionGracePeriodSeconds
+	}
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		return *pod.Spec.TerminationGracePeriodSeconds
+	}
+	return defaultTerminationGracePeriod
+}
+
+// runLifecycleHandler 执行exec或httpGet类型的hook，返回hook的输出
+func (c *CriProvider) runLifecycleHandler(ctx context.Context, sandboxId string, pod *v1.Pod, container *v1.Container, cId string, handler *v1.Handler) (string, error) {
+	switch {
+	case handler.Exec != nil:
+		// 超时由ctx控制
+		r, err := remote.ExecSync(ctx, c.remoteCRI.RuntimeService, cId, handler.Exec.Command, 0)
+		if err != nil {
+			return "", err
+		}
+		output := truncateProbeOutput(string(r.Stdout) + string(r.Stderr))
+		if r.ExitCode != 0 {
+			return output, fmt.Errorf("command %q exited with %d", handler.Exec.Command, r.ExitCode)
+		}
+		return output, nil
+	case handler.HTTPGet != nil:
+		ok, output := c.httpGet(ctx, handler.HTTPGet, pod, container, sandboxId, 0)
+		if !ok {
+			return "", fmt.Errorf("http lifecycle hook failed: %s", output)
+		}
+		return output, nil
+	}
+	return "", fmt.Errorf("cannot run handler: unknown action")
+}
+
+// runPostStartHook 容器启动后执行postStart，失败时停止容器
+func (c *CriProvider) runPostStartHook(ctx context.Context, sandboxId string, pod *v1.Pod, container *v1.Container, cId string) error {
+	if container.Lifecycle == nil || container.Lifecycle.PostStart == nil {
+		return nil
+	}
+	output, err := c.runLifecycleHandler(ctx, sandboxId, pod, container, cId, container.Lifecycle.PostStart)
+	if err == nil {
+		return nil
+	}
+	c.recordEvent(pod, v1.EventTypeWarning, eventFailedPostStartHook,
+		"PostStartHook for Container %q in Pod %q failed - error: %v, message: %q", container.Name, pod.Name, err, output)
+	if killErr := c.killContainer(ctx, sandboxId, pod, container, cId, podGracePeriod(pod)); killErr != nil {
+		klog.Errorf("kill container %s after postStart failed err: %s", container.Name, killErr)
+	}
+	return fmt.Errorf("PostStartHookError: %v", err)
+}
+
+// killContainer 停止容器：先执行preStop，最多等待gracePeriod秒，剩余的宽限时间用于StopContainer
+func (c *CriProvider) killContainer(ctx context.Context, sandboxId string, pod *v1.Pod, container *v1.Container, cId string, gracePeriod int64) error {
+	start := time.Now()
+	if container.Lifecycle != nil && container.Lifecycle.PreStop != nil && gracePeriod > 0 {
+		hookCtx, cancel := context.WithTimeout(ctx, time.Duration(gracePeriod)*time.Second)
+		output, err := c.runLifecycleHandler(hookCtx, sandboxId, pod, container, cId, container.Lifecycle.PreStop)
+		cancel()
+		if err != nil {
+			c.recordEvent(pod, v1.EventTypeWarning, eventFailedPreStopHook,
+				"PreStopHook for Container %q in Pod %q failed - error: %v, message: %q", container.Name, pod.Name, err, output)
+		}
+		gracePeriod -= int64(time.Since(start).Seconds())
+	}
+	if gracePeriod < minimumGracePeriod {
+		gracePeriod = minimumGracePeriod
+	}
+	klog.Infof("Stopping container %s of pod %s/%s with grace period %ds", container.Name, pod.Namespace, pod.Name, gracePeriod)
+	return remote.StopContainer(ctx, c.remoteCRI.RuntimeService, cId, gracePeriod)
+}
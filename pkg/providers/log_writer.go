@@ -0,0 +1,204 @@
+package providers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// samplePodLogMaxSize 简易pod单个日志文件的最大大小，超过后轮转
+	samplePodLogMaxSize = 10 * 1024 * 1024
+	// samplePodLogMaxFiles 简易pod保留的日志文件数(包含正在写入的文件)
+	samplePodLogMaxFiles = 3
+	// maxCRILogLineSize 单行日志的最大长度，超过后拆分为多个P标记的行
+	maxCRILogLineSize = 16 * 1024
+	// maxStatusMessageSize 容器状态Message中最多保留的输出字节数
+	maxStatusMessageSize = 1024
+)
+
+// criLogWriter 将进程输出以CRI日志格式写入文件，并按大小轮转
+type criLogWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// newCRILogWriter 打开(或创建)日志文件，已有内容时追加写入
+func newCRILogWriter(path string, maxSize int64, maxFiles int) (*criLogWriter, error) {
+	lw := &criLogWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := lw.open(); err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+func (lw *criLogWriter) open() error {
+	f, err := os.OpenFile(lw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lw.f = f
+	lw.size = fi.Size()
+	return nil
+}
+
+// Stream 返回写入指定输出流(stdout/stderr)的Writer
+func (lw *criLogWriter) Stream(stream string) *criStreamWriter {
+	return &criStreamWriter{lw: lw, stream: stream}
+}
+
+// writeLine 写入一行CRI格式的日志
+func (lw *criLogWriter) writeLine(stream string, partial bool, content []byte) error {
+	tag := "F"
+	if partial {
+		tag = criLogTagPartial
+	}
+	var line bytes.Buffer
+	line.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(fmt.Sprintf(" %s %s ", stream, tag))
+	line.Write(content)
+	line.WriteByte('\n')
+
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.f == nil {
+		return os.ErrClosed
+	}
+	if lw.maxSize > 0 && lw.size > 0 && lw.size+int64(line.Len()) > lw.maxSize {
+		if err := lw.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := lw.f.Write(line.Bytes())
+	lw.size += int64(n)
+	return err
+}
+
+// rotate 轮转日志文件：path -> path.1 -> path.2 ...，超出maxFiles的文件被删除
+func (lw *criLogWriter) rotate() error {
+	if err := lw.f.Close(); err != nil {
+		return err
+	}
+	lw.f = nil
+	for i := lw.maxFiles - 1; i > 0; i-- {
+		src := lw.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", lw.path, i-1)
+		}
+		dst := fmt.Sprintf("%s.%d", lw.path, i)
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if lw.maxFiles <= 1 {
+		if err := os.Remove(lw.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return lw.open()
+}
+
+// Close 关闭日志文件
+func (lw *criLogWriter) Close() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.f == nil {
+		return nil
+	}
+	err := lw.f.Close()
+	lw.f = nil
+	return err
+}
+
+// criStreamWriter 单个输出流的Writer，按换行符切分为CRI日志行
+type criStreamWriter struct {
+	lw     *criLogWriter
+	stream string
+	buf    []byte
+}
+
+func (w *criStreamWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := w.writeFull(w.buf[:idx]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	// 过长且没有换行的输出，先以不完整行写入
+	for len(w.buf) >= maxCRILogLineSize {
+		if err := w.lw.writeLine(w.stream, true, w.buf[:maxCRILogLineSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[maxCRILogLineSize:]
+	}
+	w.buf = append([]byte(nil), w.buf...)
+	return len(p), nil
+}
+
+// writeFull 写入完整的一行，过长时拆分
+func (w *criStreamWriter) writeFull(line []byte) error {
+	for len(line) > maxCRILogLineSize {
+		if err := w.lw.writeLine(w.stream, true, line[:maxCRILogLineSize]); err != nil {
+			return err
+		}
+		line = line[maxCRILogLineSize:]
+	}
+	return w.lw.writeLine(w.stream, false, line)
+}
+
+// Flush 写入剩余没有换行符的输出
+func (w *criStreamWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeFull(w.buf)
+	w.buf = nil
+	return err
+}
+
+// tailBuffer 只保留最后max个字节的输出，用于容器状态的Message
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.max:]...)
+		t.truncated = true
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	if t.truncated {
+		return "..." + string(t.buf)
+	}
+	return string(t.buf)
+}
@@ -0,0 +1,346 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"k8s.io/apimachinery/pkg/types"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// criLogTagPartial CRI日志中的标记，代表此行为不完整的一行
+	criLogTagPartial = "P"
+	// logFollowPeriod follow模式下轮询日志文件的周期
+	logFollowPeriod = 250 * time.Millisecond
+	// logTailBlockSize 反向查找tail行时，每次读取的块大小
+	logTailBlockSize = 4096
+)
+
+// errLimitReached 输出的日志已达到LimitBytes限制
+var errLimitReached = errors.New("log limit reached")
+
+// criLogMessage CRI日志文件中的一行日志
+type criLogMessage struct {
+	timestamp time.Time
+	stream    string
+	partial   bool
+	log       []byte
+}
+
+// getContainerLogs 获取容器日志
+func (c *CriProvider) getContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
+	// 刷新node中pod状态
+	err := c.refreshNodeState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pod := c.findPodByName(namespace, podName)
+	if pod == nil {
+		return nil, errdefs.NotFoundf("pod %s in namespace %s could not be found on the node", podName, namespace)
+	}
+	cs, ok := pod.containers[containerName]
+	if !ok {
+		return nil, errdefs.NotFoundf("container %s in pod %s could not be found", containerName, podName)
+	}
+
+	attempt := cs.Metadata.Attempt
+	if opts.Previous {
+		if attempt == 0 {
+			return nil, errdefs.NotFoundf("previous terminated container %s in pod %s not found", containerName, podName)
+		}
+		attempt--
+	}
+	logPath := filepath.Join(c.podLogRoot, pod.status.Metadata.Uid, remote.ContainerLogFileName(containerName, attempt))
+
+	// 判断容器是否还在运行，follow模式下容器退出后结束读取
+	isSample := c.PodManager.isSamplePod(types.UID(pod.status.Metadata.Uid))
+	running := func() bool {
+		if opts.Previous {
+			return false
+		}
+		// 简易pod的容器状态只保存在内存中，重新取出当前状态，容器重启后当前的日志文件不再写入
+		if isSample {
+			ps, ok := c.PodManager.getSamplePod(types.UID(pod.status.Metadata.Uid))
+			if !ok {
+				return false
+			}
+			current, ok := ps.containers[containerName]
+			return ok && current.Metadata.Attempt == attempt && current.State == criapi.ContainerState_CONTAINER_RUNNING
+		}
+		status, err := remote.GetContainerCRIStatus(context.Background(), c.remoteCRI.RuntimeService, cs.Id)
+		if err != nil {
+			return false
+		}
+		return status.State == criapi.ContainerState_CONTAINER_RUNNING
+	}
+
+	return openContainerLogs(ctx, logPath, opts, running)
+}
+
+// logReadCloser 读取端关闭时，同时停止后台读取日志的goroutine
+type logReadCloser struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (l *logReadCloser) Close() error {
+	l.cancel()
+	return l.PipeReader.Close()
+}
+
+// openContainerLogs 打开CRI格式的日志文件，按照opts的要求输出
+func openContainerLogs(ctx context.Context, logPath string, opts api.ContainerLogOpts, running func() bool) (io.ReadCloser, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errdefs.NotFoundf("log file %s not found", logPath)
+		}
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	go func() {
+		err := readLogs(ctx, f, opts, pw, running)
+		if err != nil {
+			klog.Errorf("read logs %s err: %s", logPath, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return &logReadCloser{PipeReader: pr, cancel: cancel}, nil
+}
+
+// readLogs 逐行解析CRI日志并写入w，支持Tail、LimitBytes、SinceSeconds、SinceTime、Timestamps、Follow。
+// 读取结束后关闭f，follow模式下日志文件轮转时会重新打开同一路径的新文件
+func readLogs(ctx context.Context, f *os.File, opts api.ContainerLogOpts, w io.Writer, running func() bool) error {
+	defer func() {
+		f.Close()
+	}()
+	if opts.Tail > 0 {
+		offset, err := tailOffset(f, opts.Tail)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	var since time.Time
+	if !opts.SinceTime.IsZero() {
+		since = opts.SinceTime
+	} else if opts.SinceSeconds > 0 {
+		since = time.Now().Add(-time.Duration(opts.SinceSeconds) * time.Second)
+	}
+
+	lw := &limitedWriter{w: w, limit: int64(opts.LimitBytes)}
+	r := bufio.NewReader(f)
+	var (
+		pending []byte
+		drained bool
+		rotated bool
+		msg     criLogMessage
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		pending = append(pending, line...)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// 读到完整的一行，或非follow模式下读到了文件末尾
+		if err == nil || (!opts.Follow && len(pending) > 0) {
+			werr := writeLogLine(pending, &msg, since, opts.Timestamps, lw)
+			pending = pending[:0]
+			if werr == errLimitReached {
+				return nil
+			}
+			if werr != nil {
+				return werr
+			}
+			if err == nil {
+				continue
+			}
+		}
+		if !opts.Follow {
+			return nil
+		}
+
+		// 日志文件已轮转，读完旧文件的剩余内容后切换到新文件
+		if rotated {
+			nf, err := os.Open(f.Name())
+			if err != nil {
+				return err
+			}
+			f.Close()
+			f = nf
+			r.Reset(f)
+			rotated = false
+			continue
+		}
+		if logRotated(f) {
+			rotated = true
+			continue
+		}
+
+		// follow模式：容器退出后再读取一次，防止遗漏退出前写入的日志
+		if !running() {
+			if drained {
+				return nil
+			}
+			drained = true
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logFollowPeriod):
+		}
+	}
+}
+
+// logRotated 判断日志文件路径是否已指向新的文件
+func logRotated(f *os.File) bool {
+	cur, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(cur, fi)
+}
+
+// writeLogLine 解析一行CRI日志并输出
+func writeLogLine(line []byte, msg *criLogMessage, since time.Time, timestamps bool, w io.Writer) error {
+	if err := parseCRILog(line, msg); err != nil {
+		klog.Warningf("parse cri log line %q err: %s", line, err)
+		return nil
+	}
+	if !since.IsZero() && msg.timestamp.Before(since) {
+		return nil
+	}
+	if timestamps {
+		if _, err := io.WriteString(w, msg.timestamp.Format(time.RFC3339Nano)+" "); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(msg.log)
+	return err
+}
+
+// parseCRILog 解析CRI格式的日志行，格式如下：
+// 2016-10-06T00:17:09.669794202Z stdout F log content
+func parseCRILog(line []byte, msg *criLogMessage) error {
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+
+	idx := bytes.IndexByte(line, ' ')
+	if idx < 0 {
+		return fmt.Errorf("timestamp is not found")
+	}
+	ts, err := time.Parse(time.RFC3339Nano, string(line[:idx]))
+	if err != nil {
+		return fmt.Errorf("unexpected timestamp format %q: %s", line[:idx], err)
+	}
+	msg.timestamp = ts
+
+	line = line[idx+1:]
+	idx = bytes.IndexByte(line, ' ')
+	if idx < 0 {
+		return fmt.Errorf("stream type is not found")
+	}
+	msg.stream = string(line[:idx])
+	if msg.stream != "stdout" && msg.stream != "stderr" {
+		return fmt.Errorf("unexpected stream type %q", msg.stream)
+	}
+
+	line = line[idx+1:]
+	idx = bytes.IndexByte(line, ' ')
+	if idx < 0 {
+		return fmt.Errorf("log tag is not found")
+	}
+	// 标记可能有多个，使用":"分割，第一个标记表示是否完整
+	tags := bytes.Split(line[:idx], []byte{':'})
+	msg.partial = string(tags[0]) == criLogTagPartial
+
+	msg.log = append(msg.log[:0], line[idx+1:]...)
+	// 完整的一行需要补上换行符
+	if !msg.partial {
+		msg.log = append(msg.log, '\n')
+	}
+	return nil
+}
+
+// tailOffset 从文件末尾反向查找，返回最后n行的起始偏移量
+func tailOffset(f *os.File, n int) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	buf := make([]byte, logTailBlockSize)
+	count := 0
+	end := size
+	for end > 0 {
+		start := end - logTailBlockSize
+		if start < 0 {
+			start = 0
+		}
+		b := buf[:end-start]
+		if _, err := f.ReadAt(b, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(b) - 1; i >= 0; i-- {
+			// 忽略文件末尾的换行符
+			if b[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			count++
+			if count == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// limitedWriter 限制最多写入limit个字节，limit <= 0 时不限制
+type limitedWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.w.Write(p)
+	}
+	remain := l.limit - l.written
+	if remain <= 0 {
+		return 0, errLimitReached
+	}
+	truncated := false
+	if int64(len(p)) > remain {
+		p = p[:remain]
+		truncated = true
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	if err == nil && truncated {
+		err = errLimitReached
+	}
+	return n, err
+}
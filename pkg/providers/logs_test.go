@@ -0,0 +1,160 @@
+package providers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCRILog(t *testing.T) {
+	ts, _ := time.Parse(time.RFC3339Nano, "2016-10-06T00:17:09.669794202Z")
+	tests := []struct {
+		name    string
+		line    string
+		want    criLogMessage
+		wantErr bool
+	}{
+		{
+			name: "full line",
+			line: "2016-10-06T00:17:09.669794202Z stdout F log content\n",
+			want: criLogMessage{timestamp: ts, stream: "stdout", log: []byte("log content\n")},
+		},
+		{
+			name: "partial line",
+			line: "2016-10-06T00:17:09.669794202Z stderr P part",
+			want: criLogMessage{timestamp: ts, stream: "stderr", partial: true, log: []byte("part")},
+		},
+		{
+			name: "multiple tags",
+			line: "2016-10-06T00:17:09.669794202Z stdout F:x log",
+			want: criLogMessage{timestamp: ts, stream: "stdout", log: []byte("log\n")},
+		},
+		{
+			name: "empty content",
+			line: "2016-10-06T00:17:09.669794202Z stdout F ",
+			want: criLogMessage{timestamp: ts, stream: "stdout", log: []byte("\n")},
+		},
+		{
+			name:    "missing timestamp",
+			line:    "log",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timestamp",
+			line:    "2016-10-06 stdout F log",
+			wantErr: true,
+		},
+		{
+			name:    "missing stream",
+			line:    "2016-10-06T00:17:09.669794202Z stdout",
+			wantErr: true,
+		},
+		{
+			name:    "unknown stream",
+			line:    "2016-10-06T00:17:09.669794202Z stdin F log",
+			wantErr: true,
+		},
+		{
+			name:    "missing tag",
+			line:    "2016-10-06T00:17:09.669794202Z stdout F",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg criLogMessage
+			err := parseCRILog([]byte(tt.line), &msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCRILog() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !msg.timestamp.Equal(tt.want.timestamp) || msg.stream != tt.want.stream ||
+				msg.partial != tt.want.partial || !bytes.Equal(msg.log, tt.want.log) {
+				t.Errorf("parseCRILog() = %+v, want %+v", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailOffset(t *testing.T) {
+	// 超过一个块大小的内容，检查跨块查找
+	var long strings.Builder
+	for i := 0; i < 1000; i++ {
+		long.WriteString("0123456789\n")
+	}
+	tests := []struct {
+		name    string
+		content string
+		n       int
+		want    int64
+	}{
+		{name: "empty file", content: "", n: 1, want: 0},
+		{name: "last line", content: "a\nb\nc\n", n: 1, want: 4},
+		{name: "last two lines", content: "a\nb\nc\n", n: 2, want: 2},
+		{name: "all lines", content: "a\nb\nc\n", n: 3, want: 0},
+		{name: "more than lines", content: "a\nb\nc\n", n: 10, want: 0},
+		{name: "no trailing newline", content: "a\nb\nc", n: 1, want: 4},
+		{name: "across blocks", content: long.String(), n: 500, want: int64(500 * 11)},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Repeat("f", i+1))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := tailOffset(f, tt.n)
+			if err != nil {
+				t.Fatalf("tailOffset() err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("tailOffset() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		writes  []string
+		want    string
+		wantErr error
+	}{
+		{name: "no limit", limit: 0, writes: []string{"hello", "world"}, want: "helloworld"},
+		{name: "under limit", limit: 20, writes: []string{"hello", "world"}, want: "helloworld"},
+		{name: "exact limit", limit: 10, writes: []string{"hello", "world"}, want: "helloworld"},
+		{name: "truncated", limit: 7, writes: []string{"hello", "world"}, want: "hellowo", wantErr: errLimitReached},
+		{name: "already reached", limit: 5, writes: []string{"hello", "world"}, want: "hello", wantErr: errLimitReached},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := &limitedWriter{w: &buf, limit: tt.limit}
+			var err error
+			for _, s := range tt.writes {
+				if _, err = w.Write([]byte(s)); err != nil {
+					break
+				}
+			}
+			if err != tt.wantErr {
+				t.Errorf("Write() err = %v, want %v", err, tt.wantErr)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("written = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 )
@@ -13,21 +16,163 @@ type PodManager struct {
 	podStatus map[types.UID]PodStatus
 	// samplePodStatus 缓存简易版本的pod
 	samplePodStatus  map[types.UID]PodStatus
+	// statusMu 保护podStatus与samplePodStatus两个map，map中的内容不由它保护
+	statusMu sync.RWMutex
+
+	// pods 记录本节点创建的pod配置，CRI中只保存了部分信息
+	pods   map[types.UID]*v1.Pod
+	podsMu sync.RWMutex
+
+	// conditions 记录pod condition的变化时间
+	conditions   map[types.UID]*podConditions
+	conditionsMu sync.Mutex
+
+	// terminating 正在删除的pod，sandbox由我们停止，不是异常退出
+	terminating map[types.UID]bool
+	stateMu     sync.Mutex
 }
 
 func NewPodManager() *PodManager {
 	return &PodManager{
 		podStatus: map[types.UID]PodStatus{},
 		samplePodStatus: map[types.UID]PodStatus{},
+		pods:            map[types.UID]*v1.Pod{},
+		conditions:      map[types.UID]*podConditions{},
+		terminating:     map[types.UID]bool{},
 	}
 }
 
+// getPodStatus 获取CRI pod的状态，每次刷新时整体替换，返回的map不会再被修改
 func (pm *PodManager) getPodStatus() map[types.UID]PodStatus {
+	pm.statusMu.RLock()
+	defer pm.statusMu.RUnlock()
 	return pm.podStatus
 }
 
+// setPodStatus 替换CRI pod的状态
+func (pm *PodManager) setPodStatus(status map[types.UID]PodStatus) {
+	pm.statusMu.Lock()
+	defer pm.statusMu.Unlock()
+	pm.podStatus = status
+}
+
+// getSamplePodStatus 获取简易pod状态的快照，命令goroutine之后的修改不会影响返回值
 func (pm *PodManager) getSamplePodStatus() map[types.UID]PodStatus {
-	return pm.samplePodStatus
+	pm.statusMu.RLock()
+	defer pm.statusMu.RUnlock()
+	status := make(map[types.UID]PodStatus, len(pm.samplePodStatus))
+	for uid, ps := range pm.samplePodStatus {
+		status[uid] = ps.snapshot()
+	}
+	return status
+}
+
+// getSamplePod 获取单个简易pod状态的快照
+func (pm *PodManager) getSamplePod(uid types.UID) (PodStatus, bool) {
+	pm.statusMu.RLock()
+	defer pm.statusMu.RUnlock()
+	ps, ok := pm.samplePodStatus[uid]
+	if !ok {
+		return PodStatus{}, false
+	}
+	return ps.snapshot(), true
+}
+
+// getSamplePodRecord 获取简易pod的原始记录，修改其中的内容需要持有sampleMu
+func (pm *PodManager) getSamplePodRecord(uid types.UID) (PodStatus, bool) {
+	pm.statusMu.RLock()
+	defer pm.statusMu.RUnlock()
+	ps, ok := pm.samplePodStatus[uid]
+	return ps, ok
+}
+
+// setSamplePod 记录简易pod
+func (pm *PodManager) setSamplePod(uid types.UID, ps PodStatus) {
+	pm.statusMu.Lock()
+	defer pm.statusMu.Unlock()
+	pm.samplePodStatus[uid] = ps
+}
+
+// removeSamplePod 删除简易pod的记录
+func (pm *PodManager) removeSamplePod(uid types.UID) {
+	pm.statusMu.Lock()
+	defer pm.statusMu.Unlock()
+	delete(pm.samplePodStatus, uid)
+}
+
+// isSamplePod 是否为简易版本的pod(annotation type=bash)
+func (pm *PodManager) isSamplePod(uid types.UID) bool {
+	pm.statusMu.RLock()
+	defer pm.statusMu.RUnlock()
+	_, ok := pm.samplePodStatus[uid]
+	return ok
+}
+
+// setPod 记录pod配置
+func (pm *PodManager) setPod(pod *v1.Pod) {
+	pm.podsMu.Lock()
+	defer pm.podsMu.Unlock()
+	pm.pods[pod.UID] = pod
+}
+
+// removePod 删除pod配置与condition记录
+func (pm *PodManager) removePod(uid types.UID) {
+	pm.podsMu.Lock()
+	delete(pm.pods, uid)
+	pm.podsMu.Unlock()
+
+	pm.conditionsMu.Lock()
+	delete(pm.conditions, uid)
+	pm.conditionsMu.Unlock()
+
+	pm.stateMu.Lock()
+	delete(pm.terminating, uid)
+	pm.stateMu.Unlock()
+}
+
+// markTerminating 记录pod正在删除
+func (pm *PodManager) markTerminating(uid types.UID) {
+	pm.stateMu.Lock()
+	defer pm.stateMu.Unlock()
+	pm.terminating[uid] = true
+}
+
+// isTerminating pod是否正在删除
+func (pm *PodManager) isTerminating(uid types.UID) bool {
+	pm.stateMu.Lock()
+	defer pm.stateMu.Unlock()
+	return pm.terminating[uid]
+}
+
+// podConditions 获取pod的condition记录，不存在时创建
+func (pm *PodManager) podConditions(uid types.UID) *podConditions {
+	pm.conditionsMu.Lock()
+	defer pm.conditionsMu.Unlock()
+	pc, ok := pm.conditions[uid]
+	if !ok {
+		pc = newPodConditions()
+		pm.conditions[uid] = pc
+	}
+	return pc
+}
+
+// getPod 获取pod配置
+func (pm *PodManager) getPod(uid types.UID) (*v1.Pod, bool) {
+	pm.podsMu.RLock()
+	defer pm.podsMu.RUnlock()
+	pod, ok := pm.pods[uid]
+	return pod, ok
+}
+
+// listPods 获取所有pod配置
+func (pm *PodManager) listPods() []*v1.Pod {
+	pm.podsMu.RLock()
+	defer pm.podsMu.RUnlock()
+	pods := make([]*v1.Pod, 0, len(pm.pods))
+	for _, pod := range pm.pods {
+		pods = append(pods, pod)
+	}
+	return pods
 }
 
 // PodStatus 单个pod的状态记录
@@ -35,6 +180,113 @@ type PodStatus struct {
 	id string
 	// containers 储存pod中容器组的状态，criapi包中的结构
 	containers map[string]*criapi.ContainerStatus
+	// previous 容器上一次运行的状态，容器重启过时才有
+	previous map[string]*criapi.ContainerStatus
+	// waiting 处于重启退避中的容器
+	waiting map[string]*v1.ContainerStateWaiting
+	// pod 创建pod时的配置，virtual-kubelet重启后为空
+	pod *v1.Pod
+	// initContainers init容器的状态
+	initContainers map[string]*criapi.ContainerStatus
+	// conditions 记录condition的变化时间
+	conditions *podConditions
+	// gates apiserver中readinessGates对应的condition
+	gates []v1.PodCondition
+	// probes 由探针结果得到的容器ready与started
+	probes map[string]probeStatus
 	// status pod的状态，criapi包中的结构
 	status *criapi.PodSandboxStatus
+	// cmds 简易版本pod中每个容器执行的命令
+	cmds map[string]*ContainerCmd
+	// sampleMu 简易pod的锁，与cmds共用，保护容器状态、sandbox状态与命令的字段
+	sampleMu *sync.Mutex
+	// terminating pod正在删除，sandbox由我们停止
+	terminating bool
+}
+
+// snapshot 复制简易pod的状态，复制后可以在锁外读取；CRI pod的状态不会被修改，直接返回
+func (p *PodStatus) snapshot() PodStatus {
+	if p.sampleMu == nil {
+		return *p
+	}
+	p.sampleMu.Lock()
+	defer p.sampleMu.Unlock()
+	out := *p
+	status := *p.status
+	out.status = &status
+	out.containers = copyContainerStatuses(p.containers)
+	out.initContainers = copyContainerStatuses(p.initContainers)
+	out.cmds = make(map[string]*ContainerCmd, len(p.cmds))
+	for name, cc := range p.cmds {
+		out.cmds[name] = cc.snapshot()
+	}
+	return out
+}
+
+// copyContainerStatuses 复制容器状态，Metadata修改时整体替换，可以共用
+func copyContainerStatuses(in map[string]*criapi.ContainerStatus) map[string]*criapi.ContainerStatus {
+	out := make(map[string]*criapi.ContainerStatus, len(in))
+	for name, status := range in {
+		cs := *status
+		out[name] = &cs
+	}
+	return out
+}
+
+// previousStatus 容器上一次运行的状态
+func (p *PodStatus) previousStatus(name string) (*criapi.ContainerStatus, bool) {
+	if cc, ok := p.cmds[name]; ok {
+		return cc.Previous, cc.Previous != nil
+	}
+	previous, ok := p.previous[name]
+	return previous, ok
+}
+
+// waitingState 容器处于重启退避中时的等待原因
+func (p *PodStatus) waitingState(name string) (*v1.ContainerStateWaiting, bool) {
+	if cc, ok := p.cmds[name]; ok {
+		return cc.Waiting, cc.Waiting != nil
+	}
+	waiting, ok := p.waiting[name]
+	return waiting, ok
+}
+
+// restartPolicy pod的重启策略，没有pod配置时与默认值一致为Always
+func (p *PodStatus) restartPolicy() v1.RestartPolicy {
+	if p.pod == nil || p.pod.Spec.RestartPolicy == "" {
+		return v1.RestartPolicyAlways
+	}
+	return p.pod.Spec.RestartPolicy
+}
+
+// initCompleted init容器是否已经成功退出，简易pod中没有命令的容器不会运行，视为已完成
+func (p *PodStatus) initCompleted(name string) bool {
+	if _, ok := p.cmds[name]; p.cmds != nil && !ok {
+		return true
+	}
+	status, ok := p.initContainers[name]
+	return ok && status.State == criapi.ContainerState_CONTAINER_EXITED && status.ExitCode == 0
+}
+
+// initialized 所有init容器是否都已经成功退出
+func (p *PodStatus) initialized() bool {
+	if p.pod == nil {
+		return true
+	}
+	for _, container := range p.pod.Spec.InitContainers {
+		if !p.initCompleted(container.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// initFailed 是否有init容器失败退出
+func (p *PodStatus) initFailed() bool {
+	for _, status := range p.initContainers {
+		if status.State == criapi.ContainerState_CONTAINER_EXITED && status.ExitCode != 0 {
+			return true
+		}
+	}
+	return false
 }
@@ -5,14 +5,20 @@ import (
 	"k8s.io/klog/v2"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/practice/virtual-kubelet-practice/pkg/common"
 	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	"github.com/virtual-kubelet/node-cli/manager"
+	"github.com/virtual-kubelet/node-cli/provider"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/node"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 )
 
@@ -31,6 +37,18 @@ type CriProvider struct {
 	remoteCRI *remote.CRIContainer
 	// PodManager 管理pods状态管理
 	PodManager *PodManager
+	// resourceManager 获取configMap、secret等k8s资源
+	resourceManager *manager.ResourceManager
+	// volumeWatcher 监听configMap与secret的变化，没有k8s客户端时为nil
+	volumeWatcher *volumeWatcher
+	// volumeLock 防止同时写入同一个volume
+	volumeLock sync.Mutex
+	// hostPortLock 防止同时创建的pod申请相同的hostPort
+	hostPortLock sync.Mutex
+	// hostPorts pod预留的hostPort，启动时由运行中的sandbox恢复
+	hostPorts map[types.UID]hostPortReservation
+	// eventRecorder 记录pod事件，没有k8s客户端时为nil
+	eventRecorder record.EventRecorder
 	// podLogRoot 存放容器日志目录
 	podLogRoot string
 	// podVolRoot 存放容器挂载目录
@@ -40,6 +58,17 @@ type CriProvider struct {
 	// checkPeriod 检查定时周期
 	checkPeriod int64
 	notifyC     chan struct{}
+	// supervisors 每个pod的supervisor，负责重启退出的容器
+	supervisors   map[types.UID]*podSupervisor
+	supervisorsMu sync.Mutex
+	// restartBackOff 容器重启的退避记录
+	restartBackOff *flowcontrol.Backoff
+	// probes 执行容器的liveness、readiness与startup探针
+	probes *probeManager
+	// images 管理镜像拉取
+	images *imageManager
+	// cpuUsage 记录容器cpu使用的采样，用于计算cpu使用率
+	cpuUsage *cpuUsageCache
 	// 上报的回调方法，主要把本节点中的pod status放入工作队列
 	notifyStatus func(*v1.Pod)
 
@@ -52,16 +81,30 @@ type CriProvider struct {
 var _ node.PodLifecycleHandler = &CriProvider{}
 var _ node.PodNotifier = &CriProvider{}
 
+// 实现此接口后，可以提供 kubectl top 与 HPA 需要的资源使用情况
+var _ provider.PodMetricsProvider = &CriProvider{}
+
 func NewCriProvider(options *common.ProviderConfig, criClient *remote.CRIContainer) *CriProvider {
 
 	c := &CriProvider{
-		options:    options,
-		remoteCRI:  criClient,
-		podLogRoot: PodLogRoot,
-		podVolRoot: PodVolRoot,
-		PodManager: NewPodManager(),
-		nodeName:   options.NodeName,
-		notifyC:    make(chan struct{}),
+		options:         options,
+		remoteCRI:       criClient,
+		resourceManager: options.ResourceManager,
+		podLogRoot:      PodLogRoot,
+		podVolRoot:      PodVolRoot,
+		PodManager:      NewPodManager(),
+		nodeName:        options.NodeName,
+		notifyC:         make(chan struct{}, 1),
+		cpuUsage:        newCPUUsageCache(),
+		supervisors:     make(map[types.UID]*podSupervisor),
+		restartBackOff:  newRestartBackOff(),
+		probes:          newProbeManager(),
+		images:          newImageManager(),
+		hostPorts:       make(map[types.UID]hostPortReservation),
+	}
+	if options.KubeClient != nil {
+		c.volumeWatcher = newVolumeWatcher(options.KubeClient, c.syncVolumesFor)
+		c.eventRecorder = newEventRecorder(options.KubeClient, options.NodeName)
 	}
 	// 初始化时先创建目录
 	err := os.MkdirAll(c.podLogRoot, PodLogRootPerms)
@@ -79,10 +122,25 @@ func NewCriProvider(options *common.ProviderConfig, criClient *remote.CRIContain
 // 需要实现 node.PodNotifier 对象
 func (c *CriProvider) NotifyPods(ctx context.Context, notifyStatus func(*v1.Pod)) {
 	c.notifyStatus = notifyStatus
+	if err := c.restoreHostPorts(ctx); err != nil {
+		klog.Error("restoreHostPorts err: ", err)
+	}
+	if c.volumeWatcher != nil {
+		c.volumeWatcher.start(ctx)
+	}
 	go c.checkPodStatusLoop(ctx)
 	go c.checkSamplePodStatusLoop()
 }
 
+// notifySamplePods 通知上报简易pod的状态，已经有通知在等待时不再重复发送，
+// 上报时会读取所有简易pod的最新状态
+func (c *CriProvider) notifySamplePods() {
+	select {
+	case c.notifyC <- struct{}{}:
+	default:
+	}
+}
+
 // FIXME: 暂时使用此方式 通知
 func (c *CriProvider) checkSamplePodStatusLoop() {
 	for {
@@ -90,7 +148,8 @@ func (c *CriProvider) checkSamplePodStatusLoop() {
 		case <-c.notifyC:
 			var pods []*v1.Pod
 
-			for _, ps := range c.PodManager.samplePodStatus {
+			for _, ps := range c.PodManager.getSamplePodStatus() {
+				ps.gates = c.readinessGateConditions(ps.pod)
 				pods = append(pods, createPodSpecFromCRI(&ps, c.nodeName))
 			}
 
@@ -144,29 +203,73 @@ func (c *CriProvider) notifyPodStatuses(ctx context.Context) error {
 }
 
 // createPod 创建pod业务逻辑
-func (c *CriProvider) createPod(ctx context.Context, pod *v1.Pod) error {
+func (c *CriProvider) createPod(ctx context.Context, pod *v1.Pod) (err error) {
 
-	var attempt uint32 // TODO: Track attempts. Currently always 0
+	// sandbox不会重建，attempt始终为0，容器的重启次数由supervisor维护
+	var attempt uint32
 	logPath := filepath.Join(c.podLogRoot, string(pod.UID))
 	volPath := filepath.Join(c.podVolRoot, string(pod.UID))
 	// 刷新node中状态
-	err := c.refreshNodeState(ctx)
+	err = c.refreshNodeState(ctx)
 	if err != nil {
 		klog.Error("refreshNodeState err: ", err)
 		return err
 	}
-	// 生成pod sandbox配置文件
-	pConfig, err := remote.GeneratePodSandboxConfig(ctx, pod, logPath, attempt)
+	// 检查securityContext能否生效
+	if reason, err := validatePodSecurityContext(pod); err != nil {
+		c.recordEvent(pod, v1.EventTypeWarning, reason, "Pod rejected: %v", err)
+		return err
+	}
+	dnsConfig, err := c.podDNSConfig(pod)
+	if err != nil {
+		klog.Error("podDNSConfig err: ", err)
+		return err
+	}
+	// 生成pod sandbox配置文件，sandbox带有本节点的标签
+	pConfig, err := remote.GeneratePodSandboxConfig(ctx, pod, c.nodeName, logPath, attempt, dnsConfig, c.options.ClusterDomain)
 	if err != nil {
 		klog.Error("GeneratePodSandboxConfig err: ", err)
 		return err
 	}
+	// 记录hostPort，重启后由sandbox恢复预留。Annotations与pod共用，修改前先复制
+	if ports := podHostPorts(pod); len(ports) > 0 {
+		annotations := make(map[string]string, len(pConfig.Annotations)+1)
+		for k, v := range pConfig.Annotations {
+			annotations[k] = v
+		}
+		annotations[hostPortsAnnotation] = encodeHostPorts(ports)
+		pConfig.Annotations = annotations
+	}
 	// 获取pod对象，用于判断是否创建过。
 	existing := c.findPodByName(pod.Namespace, pod.Name)
 
 	// TODO: Is re-using an existing sandbox with the UID the correct behavior?
-	// TODO: Should delete the sandbox if container creation fails
 	var pId string
+	// 已经存在的容器由supervisor按照restartPolicy处理，回滚时保留
+	created := make(map[string]bool)
+	if existing == nil {
+		// 检查hostPort是否冲突，sandbox创建后端口会被pod自己占用，只在首次创建时检查
+		err = c.reserveHostPorts(pod)
+		if err != nil {
+			c.recordEvent(pod, v1.EventTypeWarning, eventHostPortConflict, "Pod rejected: %v", err)
+			return err
+		}
+	} else {
+		containers, err := remote.GetContainersForSandbox(ctx, c.remoteCRI.RuntimeService, existing.id)
+		if err != nil {
+			klog.Error("GetContainersForSandbox err: ", err)
+			return err
+		}
+		for name := range groupContainersByName(containers) {
+			created[name] = true
+		}
+	}
+	// 创建失败时回滚本次创建的容器，sandbox是本次创建的时一并删除
+	defer func() {
+		if err != nil {
+			c.rollbackPod(pod, pId, existing == nil, created, err)
+		}
+	}()
 	if existing == nil {
 		err = os.MkdirAll(logPath, 0755)
 		if err != nil {
@@ -183,45 +286,145 @@ func (c *CriProvider) createPod(ctx context.Context, pod *v1.Pod) error {
 			return err
 		}
 	} else {
-		pId = existing.status.Metadata.Uid
+		pId = existing.id
 	}
 
 	klog.Infof("PodSandbox id %s", pId)
 
-	// 执行创建容器相关的操作
-	for _, cs := range pod.Spec.Containers {
-		// 拉取镜像
-		imageRef, err := remote.PullImage(ctx, c.remoteCRI.ImageService, cs.Image)
+	// 环境变量中的status.podIP等字段需要sandbox创建后才能确定
+	runtimePod, err := c.runtimePod(ctx, pod, pId)
+	if err != nil {
+		klog.Error("GetPodSandboxStatus err: ", err)
+		return err
+	}
+	// 准备pod的volume
+	volumes, err := c.mountPodVolumes(runtimePod)
+	if err != nil {
+		klog.Error("mountPodVolumes err: ", err)
+		return err
+	}
+	// 有不支持的volume时不回滚pod，容器保持ContainerCreating并显示原因
+	volumeErr := unsupportedVolumeError(runtimePod)
+	if volumeErr != nil {
+		c.recordEvent(pod, v1.EventTypeWarning, eventFailedMount, "%v", volumeErr)
+	}
+	if paths := serviceAccountTokenPaths(runtimePod); len(paths) > 0 {
+		c.recordEvent(pod, v1.EventTypeWarning, eventFailedMount,
+			"serviceAccountToken projection is not supported, containers start without token files %s", strings.Join(paths, ", "))
+	}
+	// hosts文件需要pod ip，在sandbox创建后生成
+	etcHostsPath, err := c.writeEtcHosts(runtimePod)
+	if err != nil {
+		klog.Error("writeEtcHosts err: ", err)
+		return err
+	}
+	// 记录pod配置并监听volume引用的对象，configMap与secret变化时需要更新volume
+	c.PodManager.setPod(runtimePod)
+	c.watchPodVolumes(runtimePod)
+
+	rt := &podRuntime{
+		pod:           runtimePod,
+		sandboxId:     pId,
+		sandboxConfig: pConfig,
+		volumes:       volumes,
+		etcHostsPath:  etcHostsPath,
+		volumeErr:     volumeErr,
+	}
+	// 执行创建容器相关的操作，有init容器时由supervisor依次运行init容器后再创建
+	waiting := make(map[string]*v1.ContainerStateWaiting)
+	for i := range pod.Spec.Containers {
+		if len(pod.Spec.InitContainers) > 0 || created[pod.Spec.Containers[i].Name] {
+			continue
+		}
+		_, err = c.startContainer(ctx, rt, &pod.Spec.Containers[i], 0)
+		// 镜像还在拉取、拉取失败或volume无法挂载时不回滚，由supervisor在镜像可用后创建容器
+		if isContainerWaitingError(err) {
+			waiting[pod.Spec.Containers[i].Name] = containerWaitingForError(err)
+			err = nil
+			continue
+		}
 		if err != nil {
-			klog.Error("PullImage err: ", err)
 			return err
 		}
+	}
+	// 按照restartPolicy重启退出的容器
+	c.startSupervisor(rt, waiting)
+	// 执行容器的探针
+	c.startProbes(rt)
+	c.notifyStatus(pod)
+	return err
+}
 
-		klog.Infof("Creating container %s", cs.Name)
-		//cConfig, err := remote.GenerateContainerConfig(ctx, &cs, pod, imageRef, volPath, c.resourceManager, attempt)
-		// 生成容器配置文件
-		cConfig, err := remote.GenerateContainerConfig(ctx, &cs, pod, imageRef, volPath, attempt)
+// rollbackPod 创建pod失败时停止并删除本次创建的容器，keep中的容器在创建前已经存在，不会删除。
+// newSandbox为true时sandbox由本次创建，同时删除sandbox、日志与volume目录以及pod记录
+func (c *CriProvider) rollbackPod(pod *v1.Pod, sandboxId string, newSandbox bool, keep map[string]bool, cause error) {
+	// 创建请求的上下文可能已经结束，回滚使用新的上下文
+	ctx := context.Background()
+	klog.Infof("rolling back pod %s/%s: %v", pod.Namespace, pod.Name, cause)
+	if sandboxId != "" {
+		containers, err := remote.GetContainersForSandbox(ctx, c.remoteCRI.RuntimeService, sandboxId)
 		if err != nil {
-			klog.Error("GenerateContainerConfig err: ", err)
-			return err
+			klog.Error("GetContainersForSandbox err: ", err)
 		}
-		// 创建容器
-		cId, err := remote.CreateContainer(ctx, c.remoteCRI.RuntimeService, cConfig, pConfig, pId)
-		if err != nil {
-			klog.Error("CreateContainer err: ", err)
-			return err
+		for _, container := range containers {
+			if container.Metadata != nil && keep[container.Metadata.Name] {
+				continue
+			}
+			if err = remote.StopContainer(ctx, c.remoteCRI.RuntimeService, container.Id, 0); err != nil {
+				klog.Error("StopContainer err: ", err)
+			}
+			if err = remote.RemoveContainer(ctx, c.remoteCRI.RuntimeService, container.Id); err != nil {
+				klog.Error("RemoveContainer err: ", err)
+			}
+		}
+	}
+	if newSandbox {
+		if sandboxId != "" {
+			if err := remote.StopPodSandbox(ctx, c.remoteCRI.RuntimeService, sandboxId); err != nil {
+				klog.Error("StopPodSandbox err: ", err)
+			}
+			if err := remote.RemovePodSandbox(ctx, c.remoteCRI.RuntimeService, sandboxId); err != nil {
+				klog.Error("RemovePodSandbox err: ", err)
+			}
 		}
+		// 释放hostPort并删除pod配置、volume监听与镜像拉取记录
+		c.PodManager.removePod(pod.UID)
+		c.releaseHostPorts(pod.UID)
+		c.unwatchPodVolumes(pod.UID)
+		c.forgetImagePulls(pod)
+		// 卸载失败时不删除volume目录，避免误删挂载进来的文件
+		if err := c.unmountPodVolumes(pod.UID); err != nil {
+			klog.Error("unmountPodVolumes err: ", err)
+		} else if err = os.RemoveAll(filepath.Join(c.podVolRoot, string(pod.UID))); err != nil {
+			klog.Error("Remove file err: ", err)
+		}
+		if err := os.RemoveAll(filepath.Join(c.podLogRoot, string(pod.UID))); err != nil {
+			klog.Error("Remove file err: ", err)
+		}
+	}
+	c.recordEvent(pod, v1.EventTypeWarning, eventFailedCreatePodContainer, "Error creating pod, created containers were removed: %v", cause)
+}
 
-		klog.Infof("Starting container %s", cs.Name)
-		// 运行容器
-		err = remote.StartContainer(context.Background(), c.remoteCRI.RuntimeService, cId)
-		if err != nil {
-			klog.Error("StartContainer err: ", err)
-			return err
+// runtimePod 返回填充了podIP与hostIP的pod，用于解析环境变量
+func (c *CriProvider) runtimePod(ctx context.Context, pod *v1.Pod, pId string) (*v1.Pod, error) {
+	runtimePod := pod.DeepCopy()
+	runtimePod.Status.HostIP = c.options.InternalIp
+	status, err := remote.GetPodSandboxStatus(ctx, c.remoteCRI.RuntimeService, pId)
+	if err != nil {
+		return nil, err
+	}
+	// hostNetwork的sandbox没有ip，与kubelet相同status.podIP为节点ip
+	if pod.Spec.HostNetwork {
+		runtimePod.Status.PodIP = c.options.InternalIp
+		runtimePod.Status.PodIPs = []v1.PodIP{{IP: c.options.InternalIp}}
+	} else if status.Network != nil && status.Network.Ip != "" {
+		runtimePod.Status.PodIP = status.Network.Ip
+		runtimePod.Status.PodIPs = []v1.PodIP{{IP: status.Network.Ip}}
+		for _, ip := range status.Network.AdditionalIps {
+			runtimePod.Status.PodIPs = append(runtimePod.Status.PodIPs, v1.PodIP{IP: ip.Ip})
 		}
 	}
-	c.notifyStatus(pod)
-	return err
+	return runtimePod, nil
 }
 
 // deletePod 删除pod业务逻辑
@@ -234,12 +437,21 @@ func (c *CriProvider) deletePod(ctx context.Context, pod *v1.Pod) error {
 		return err
 	}
 
-	ps, ok := c.PodManager.podStatus[pod.UID]
+	ps, ok := c.PodManager.getPodStatus()[pod.UID]
 	if !ok {
 		return errdefs.NotFoundf("Pod %s not found", pod.UID)
 	}
 
-	// TODO: Check pod status for running state
+	// 先停止supervisor与探针，避免停止后的容器被重启
+	c.PodManager.markTerminating(pod.UID)
+	c.stopSupervisor(pod.UID)
+	c.stopProbes(pod.UID)
+	// 先执行preStop并停止容器，再停止sandbox
+	c.killPodContainers(ctx, pod, ps.status.Id)
+	// 删除前上报容器的最终状态，包括退出码
+	if err = c.notifyPodChanged(ctx, pod); err != nil {
+		klog.Error("notifyPodChanged err: ", err)
+	}
 	// 停止pod sandbox
 	err = remote.StopPodSandbox(ctx, c.remoteCRI.RuntimeService, ps.status.Id)
 	if err != nil {
@@ -247,10 +459,19 @@ func (c *CriProvider) deletePod(ctx context.Context, pod *v1.Pod) error {
 		klog.Error("StopPodSandbox err: ", err)
 	}
 
-	// 删除日志文件
-	err = os.RemoveAll(filepath.Join(c.podVolRoot, string(pod.UID)))
+	c.PodManager.removePod(pod.UID)
+	c.releaseHostPorts(pod.UID)
+	c.unwatchPodVolumes(pod.UID)
+	// 先卸载volume目录下的挂载点，卸载失败时不删除目录，避免误删挂载进来的文件
+	err = c.unmountPodVolumes(pod.UID)
 	if err != nil {
-		klog.Error("Remove file err: ", err)
+		klog.Error("unmountPodVolumes err: ", err)
+	} else {
+		// 删除volume目录
+		err = os.RemoveAll(filepath.Join(c.podVolRoot, string(pod.UID)))
+		if err != nil {
+			klog.Error("Remove file err: ", err)
+		}
 	}
 	// 删除pod sandbox
 	err = remote.RemovePodSandbox(ctx, c.remoteCRI.RuntimeService, ps.status.Id)
@@ -259,7 +480,43 @@ func (c *CriProvider) deletePod(ctx context.Context, pod *v1.Pod) error {
 		return err
 	}
 	c.notifyStatus(pod)
-	return err
+	// 最终状态上报后不再读取日志，删除日志目录
+	if err := os.RemoveAll(filepath.Join(c.podLogRoot, string(pod.UID))); err != nil {
+		klog.Error("Remove file err: ", err)
+	}
+	return nil
+}
+
+// killPodContainers 并行停止pod中运行的容器，每个容器先执行preStop
+func (c *CriProvider) killPodContainers(ctx context.Context, pod *v1.Pod, sandboxId string) {
+	containers, err := remote.GetContainersForSandbox(ctx, c.remoteCRI.RuntimeService, sandboxId)
+	if err != nil {
+		klog.Error("GetContainersForSandbox err: ", err)
+		return
+	}
+	gracePeriod := podGracePeriod(pod)
+	var wg sync.WaitGroup
+	for _, container := range containers {
+		if container.State != criapi.ContainerState_CONTAINER_RUNNING || container.Metadata == nil {
+			continue
+		}
+		spec := &v1.Container{Name: container.Metadata.Name}
+		for _, specs := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+			for i := range specs {
+				if specs[i].Name == container.Metadata.Name {
+					spec = &specs[i]
+				}
+			}
+		}
+		wg.Add(1)
+		go func(spec *v1.Container, cId string) {
+			defer wg.Done()
+			if err := c.killContainer(ctx, sandboxId, pod, spec, cId, gracePeriod); err != nil {
+				klog.Errorf("stop container %s err: %s", spec.Name, err)
+			}
+		}(spec, container.Id)
+	}
+	wg.Wait()
 }
 
 // getPod 获取pod
@@ -287,11 +544,12 @@ func (c *CriProvider) getPods(ctx context.Context) ([]*v1.Pod, error) {
 		return nil, err
 	}
 	// 生成k8s中的pod对象
-	for _, ps := range c.PodManager.podStatus {
+	for _, ps := range c.PodManager.getPodStatus() {
 		pods = append(pods, createPodSpecFromCRI(&ps, c.nodeName))
 	}
 	// 生成k8s中的pod对象
-	for _, ps := range c.PodManager.samplePodStatus {
+	for _, ps := range c.PodManager.getSamplePodStatus() {
+		ps.gates = c.readinessGateConditions(ps.pod)
 		pods = append(pods, createPodSpecFromCRI(&ps, c.nodeName))
 	}
 	return pods, nil
@@ -303,6 +561,7 @@ func (c *CriProvider) findPodByName(namespace, name string) *PodStatus {
 
 	for _, pod := range c.PodManager.getSamplePodStatus() {
 		if pod.status.Metadata.Name == name && pod.status.Metadata.Namespace == namespace {
+			pod.gates = c.readinessGateConditions(pod.pod)
 			found = &pod
 			break
 		}
@@ -336,8 +595,8 @@ func (c *CriProvider) getPodStatus(ctx context.Context, namespace, name string)
 
 // refreshNodeState 更新node中的pod状态
 func (c *CriProvider) refreshNodeState(ctx context.Context) (retErr error) {
-	// 获取pod sandbox
-	allPods, err := remote.GetPodSandboxes(ctx, c.remoteCRI.RuntimeService)
+	// 获取本节点管理的pod sandbox
+	allPods, err := c.listOwnedSandboxes(ctx)
 	if err != nil {
 		return err
 	}
@@ -357,21 +616,90 @@ func (c *CriProvider) refreshNodeState(ctx context.Context) (retErr error) {
 		}
 
 		var css = make(map[string]*criapi.ContainerStatus)
-		for _, cc := range containers {
-			// 获取容器的状态
-			cstatus, err := remote.GetContainerCRIStatus(context.Background(), c.remoteCRI.RuntimeService, cc.Id)
-			if err != nil {
-				return err
+		var previous = make(map[string]*criapi.ContainerStatus)
+		var initCss = make(map[string]*criapi.ContainerStatus)
+		for name, attempts := range groupContainersByName(containers) {
+			// attempt最大的是当前的容器，其次是上一次运行的容器
+			for i, cc := range attempts {
+				if i > 1 {
+					break
+				}
+				// 获取容器的状态
+				cstatus, err := remote.GetContainerCRIStatus(context.Background(), c.remoteCRI.RuntimeService, cc.Id)
+				if err != nil {
+					return err
+				}
+				switch {
+				case cstatus.Labels[remote.InitContainerLabel] == "true":
+					// init容器只记录最近一次的状态
+					if i == 0 {
+						initCss[name] = cstatus
+					}
+				case i == 0:
+					css[name] = cstatus
+				default:
+					previous[name] = cstatus
+				}
 			}
-			css[cstatus.Metadata.Name] = cstatus
 		}
 
+		spec, _ := c.PodManager.getPod(types.UID(pss.Metadata.Uid))
+		// 由探针结果计算容器的ready与started
+		probes := make(map[string]probeStatus)
+		if spec != nil {
+			for i := range spec.Spec.Containers {
+				cs, ok := css[spec.Spec.Containers[i].Name]
+				if !ok {
+					continue
+				}
+				running := cs.State == criapi.ContainerState_CONTAINER_RUNNING
+				probes[cs.Metadata.Name] = c.probes.status(&spec.Spec.Containers[i], cs.Id, running)
+			}
+		}
 		newStatus[types.UID(pss.Metadata.Uid)] = PodStatus{
-			id:         pod.Id,
-			status:     pss,
-			containers: css,
+			id:             pod.Id,
+			status:         pss,
+			containers:     css,
+			previous:       previous,
+			initContainers: initCss,
+			waiting:        c.containerWaiting(types.UID(pss.Metadata.Uid)),
+			pod:            spec,
+			probes:         probes,
+			conditions:     c.PodManager.podConditions(types.UID(pss.Metadata.Uid)),
+			gates:          c.readinessGateConditions(spec),
+			terminating:    c.PodManager.isTerminating(types.UID(pss.Metadata.Uid)),
 		}
 	}
-	c.PodManager.podStatus = newStatus
+	c.PodManager.setPodStatus(newStatus)
 	return nil
 }
+
+// listOwnedSandboxes 获取本节点管理的sandbox，kubelet等其他工具创建的sandbox默认被忽略。
+// 开启AdoptForeignSandboxes时，没有节点标签并且pod调度到本节点的sandbox也会被接管
+func (c *CriProvider) listOwnedSandboxes(ctx context.Context) ([]*criapi.PodSandbox, error) {
+	if !c.options.AdoptForeignSandboxes || c.resourceManager == nil {
+		return remote.GetPodSandboxes(ctx, c.remoteCRI.RuntimeService, map[string]string{remote.NodeNameLabel: c.nodeName})
+	}
+
+	sandboxes, err := remote.GetPodSandboxes(ctx, c.remoteCRI.RuntimeService, nil)
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make(map[string]bool)
+	for _, pod := range c.resourceManager.GetPods() {
+		if pod.Spec.NodeName == c.nodeName {
+			scheduled[string(pod.UID)] = true
+		}
+	}
+	owned := make([]*criapi.PodSandbox, 0, len(sandboxes))
+	for _, sandbox := range sandboxes {
+		node, ok := sandbox.Labels[remote.NodeNameLabel]
+		switch {
+		case ok && node == c.nodeName:
+			owned = append(owned, sandbox)
+		case !ok && sandbox.Metadata != nil && scheduled[sandbox.Metadata.Uid]:
+			owned = append(owned, sandbox)
+		}
+	}
+	return owned, nil
+}
@@ -0,0 +1,429 @@
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// 与kubelet一致的探针默认值
+	defaultProbeTimeoutSeconds   = 1
+	defaultProbePeriodSeconds    = 10
+	defaultProbeSuccessThreshold = 1
+	defaultProbeFailureThreshold = 3
+	// probeUserAgent httpGet探针的User-Agent
+	probeUserAgent = "kube-probe/1.20"
+	// maxProbeOutput 事件中保留的探针输出长度
+	maxProbeOutput = 1024
+
+	// eventUnhealthy 探针失败
+	eventUnhealthy = "Unhealthy"
+	// eventKilling 停止容器
+	eventKilling = "Killing"
+)
+
+// probeType 探针类型
+type probeType int
+
+const (
+	livenessProbe probeType = iota
+	readinessProbe
+	startupProbe
+)
+
+// String 探针类型的名称，用于事件与日志
+func (t probeType) String() string {
+	switch t {
+	case livenessProbe:
+		return "Liveness"
+	case readinessProbe:
+		return "Readiness"
+	default:
+		return "Startup"
+	}
+}
+
+// probeKey 探针的唯一标识
+type probeKey struct {
+	uid       types.UID
+	container string
+	probeType probeType
+}
+
+// probeManager 管理所有探针的worker与探测结果
+type probeManager struct {
+	mu      sync.Mutex
+	workers map[probeKey]*probeWorker
+	// results 容器id与每种探针最近一次的结果，容器重启后id变化，结果自动失效
+	results map[string]map[probeType]bool
+}
+
+// probeStatus 由探针结果得到的容器状态
+type probeStatus struct {
+	ready   bool
+	started bool
+}
+
+// newProbeManager 创建探针管理器
+func newProbeManager() *probeManager {
+	return &probeManager{
+		workers: map[probeKey]*probeWorker{},
+		results: map[string]map[probeType]bool{},
+	}
+}
+
+// setResult 记录探测结果，返回结果是否变化
+func (m *probeManager) setResult(cId string, t probeType, result bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	results, ok := m.results[cId]
+	if !ok {
+		results = map[probeType]bool{}
+		m.results[cId] = results
+	}
+	old, ok := results[t]
+	results[t] = result
+	return !ok || old != result
+}
+
+// getResult 获取探测结果，没有结果时返回false
+func (m *probeManager) getResult(cId string, t probeType) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.results[cId][t]
+}
+
+// removeResults 删除容器的探测结果
+func (m *probeManager) removeResults(cId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.results, cId)
+}
+
+// status 计算容器的started与ready：
+// 有startupProbe时成功后才started，有readinessProbe时started并且探测成功才ready
+func (m *probeManager) status(container *v1.Container, cId string, running bool) probeStatus {
+	started := running && (container.StartupProbe == nil || m.getResult(cId, startupProbe))
+	ready := started && (container.ReadinessProbe == nil || m.getResult(cId, readinessProbe))
+	return probeStatus{ready: ready, started: started}
+}
+
+// probeWorker 定时执行一个容器的一种探针
+type probeWorker struct {
+	key       probeKey
+	probe     *v1.Probe
+	container *v1.Container
+	runtime   *podRuntime
+	cancel    context.CancelFunc
+
+	// containerId 当前探测的容器，容器重启后重新计数
+	containerId string
+	// lastResult 最近一次的探测结果，resultRun为连续相同结果的次数
+	lastResult bool
+	resultRun  int
+	// onHold 因liveness或startup失败停止容器后，等待新的容器再继续探测
+	onHold bool
+}
+
+// startProbes 为pod中配置了探针的容器启动worker
+func (c *CriProvider) startProbes(rt *podRuntime) {
+	c.stopProbes(rt.pod.UID)
+	c.probes.mu.Lock()
+	defer c.probes.mu.Unlock()
+	for i := range rt.pod.Spec.Containers {
+		container := &rt.pod.Spec.Containers[i]
+		for t, probe := range map[probeType]*v1.Probe{
+			livenessProbe:  container.LivenessProbe,
+			readinessProbe: container.ReadinessProbe,
+			startupProbe:   container.StartupProbe,
+		} {
+			if probe == nil {
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			w := &probeWorker{
+				key:       probeKey{uid: rt.pod.UID, container: container.Name, probeType: t},
+				probe:     probe,
+				container: container,
+				runtime:   rt,
+				cancel:    cancel,
+			}
+			c.probes.workers[w.key] = w
+			go c.runProbeWorker(ctx, w)
+		}
+	}
+}
+
+// stopProbes 停止pod的所有worker，worker退出时删除探测结果
+func (c *CriProvider) stopProbes(uid types.UID) {
+	c.probes.mu.Lock()
+	defer c.probes.mu.Unlock()
+	for key, w := range c.probes.workers {
+		if key.uid != uid {
+			continue
+		}
+		w.cancel()
+		delete(c.probes.workers, key)
+	}
+}
+
+// runProbeWorker 按照periodSeconds周期执行探针，ctx结束时退出
+func (c *CriProvider) runProbeWorker(ctx context.Context, w *probeWorker) {
+	ticker := time.NewTicker(time.Duration(int32OrDefault(w.probe.PeriodSeconds, defaultProbePeriodSeconds)) * time.Second)
+	defer ticker.Stop()
+	defer func() {
+		c.probes.removeResults(w.containerId)
+	}()
+	for {
+		if err := c.doProbe(ctx, w); err != nil && ctx.Err() == nil {
+			klog.Errorf("%s probe of container %s in pod %s/%s err: %s", w.key.probeType, w.container.Name,
+				w.runtime.pod.Namespace, w.runtime.pod.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// doProbe 执行一次探测，连续的结果达到阈值后才更新，liveness与startup失败时停止容器
+func (c *CriProvider) doProbe(ctx context.Context, w *probeWorker) error {
+	rt := w.runtime
+	pod := rt.pod
+	containers, err := remote.GetContainersForSandbox(ctx, c.remoteCRI.RuntimeService, rt.sandboxId)
+	if err != nil {
+		return err
+	}
+	attempts := groupContainersByName(containers)[w.container.Name]
+	if len(attempts) == 0 {
+		return nil
+	}
+	latest := attempts[0]
+	// 容器重启后重新开始计数
+	if latest.Id != w.containerId {
+		if w.containerId != "" {
+			c.probes.removeResults(w.containerId)
+		}
+		w.containerId = latest.Id
+		w.resultRun = 0
+		w.onHold = false
+	}
+	if latest.State != criapi.ContainerState_CONTAINER_RUNNING || w.onHold {
+		return nil
+	}
+	// 与kubelet相同，startupProbe成功后容器已经启动，不再执行，之后的失败不能影响其他探针或停止容器
+	if w.key.probeType == startupProbe && c.probes.getResult(latest.Id, startupProbe) {
+		return nil
+	}
+	// startupProbe成功之前不执行其他探针
+	if w.key.probeType != startupProbe && w.container.StartupProbe != nil &&
+		!c.probes.getResult(latest.Id, startupProbe) {
+		return nil
+	}
+	status, err := remote.GetContainerCRIStatus(ctx, c.remoteCRI.RuntimeService, latest.Id)
+	if err != nil {
+		return err
+	}
+	initialDelay := time.Duration(w.probe.InitialDelaySeconds) * time.Second
+	if time.Since(time.Unix(0, status.StartedAt)) < initialDelay {
+		return nil
+	}
+
+	result, output := c.runProbe(ctx, w, latest.Id)
+	if w.resultRun > 0 && result == w.lastResult {
+		w.resultRun++
+	} else {
+		w.lastResult = result
+		w.resultRun = 1
+	}
+	if !result {
+		c.recordEvent(pod, v1.EventTypeWarning, eventUnhealthy, "%s probe failed: %s", w.key.probeType, output)
+	}
+	if (!result && w.resultRun < int(int32OrDefault(w.probe.FailureThreshold, defaultProbeFailureThreshold))) ||
+		(result && w.resultRun < int(int32OrDefault(w.probe.SuccessThreshold, defaultProbeSuccessThreshold))) {
+		return nil
+	}
+
+	changed := c.probes.setResult(latest.Id, w.key.probeType, result)
+	if !result && w.key.probeType != readinessProbe {
+		// liveness与startup失败时停止容器，由supervisor按照restartPolicy重启
+		c.recordEvent(pod, v1.EventTypeNormal, eventKilling, "Container %s failed %s probe, will be restarted",
+			w.container.Name, strings.ToLower(w.key.probeType.String()))
+		w.onHold = true
+		w.resultRun = 0
+		if err = c.killContainer(ctx, rt.sandboxId, pod, w.container, latest.Id, podGracePeriod(pod)); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed && w.key.probeType != livenessProbe {
+		return c.notifyPodChanged(ctx, pod)
+	}
+	return nil
+}
+
+// runProbe 执行exec、httpGet或tcpSocket探针，返回是否成功与输出
+func (c *CriProvider) runProbe(ctx context.Context, w *probeWorker, cId string) (bool, string) {
+	probe := w.probe
+	timeout := time.Duration(int32OrDefault(probe.TimeoutSeconds, defaultProbeTimeoutSeconds)) * time.Second
+	switch {
+	case probe.Exec != nil:
+		r, err := remote.ExecSync(ctx, c.remoteCRI.RuntimeService, cId, probe.Exec.Command, int64(timeout.Seconds()))
+		if err != nil {
+			return false, err.Error()
+		}
+		output := truncateProbeOutput(string(r.Stdout) + string(r.Stderr))
+		if r.ExitCode != 0 {
+			return false, fmt.Sprintf("command %q exited with %d: %s", probe.Exec.Command, r.ExitCode, output)
+		}
+		return true, output
+	case probe.HTTPGet != nil:
+		return c.httpGet(ctx, probe.HTTPGet, w.runtime.pod, w.container, w.runtime.sandboxId, timeout)
+	case probe.TCPSocket != nil:
+		return c.probeTCP(ctx, w, timeout)
+	}
+	return false, "missing probe handler"
+}
+
+// httpGet 发送httpGet探针或hook的请求，状态码在[200,400)之间为成功，timeout为0时不限制
+func (c *CriProvider) httpGet(ctx context.Context, action *v1.HTTPGetAction, pod *v1.Pod, container *v1.Container, sandboxId string, timeout time.Duration) (bool, string) {
+	host := action.Host
+	if host == "" {
+		ip, err := c.podIP(ctx, pod, sandboxId)
+		if err != nil {
+			return false, err.Error()
+		}
+		host = ip
+	}
+	port, err := resolveProbePort(action.Port, container)
+	if err != nil {
+		return false, err.Error()
+	}
+	scheme := strings.ToLower(string(action.Scheme))
+	if scheme == "" {
+		scheme = "http"
+	}
+	u, err := url.Parse(action.Path)
+	if err != nil {
+		return false, err.Error()
+	}
+	u.Scheme = scheme
+	u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	req.Header.Set("User-Agent", probeUserAgent)
+	req.Header.Set("Accept", "*/*")
+	for _, header := range action.HTTPHeaders {
+		if strings.EqualFold(header.Name, "Host") {
+			req.Host = header.Value
+			continue
+		}
+		req.Header.Set(header.Name, header.Value)
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusBadRequest {
+		return true, ""
+	}
+	return false, fmt.Sprintf("HTTP probe failed with statuscode: %d", resp.StatusCode)
+}
+
+// probeTCP 能够建立tcp连接即为成功
+func (c *CriProvider) probeTCP(ctx context.Context, w *probeWorker, timeout time.Duration) (bool, string) {
+	action := w.probe.TCPSocket
+	host := action.Host
+	if host == "" {
+		ip, err := c.podIP(ctx, w.runtime.pod, w.runtime.sandboxId)
+		if err != nil {
+			return false, err.Error()
+		}
+		host = ip
+	}
+	port, err := resolveProbePort(action.Port, w.container)
+	if err != nil {
+		return false, err.Error()
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return false, err.Error()
+	}
+	_ = conn.Close()
+	return true, ""
+}
+
+// podIP 获取sandbox当前的ip，hostNetwork的sandbox没有ip，与kubelet相同使用节点ip
+func (c *CriProvider) podIP(ctx context.Context, pod *v1.Pod, sandboxId string) (string, error) {
+	if pod.Spec.HostNetwork {
+		return c.options.InternalIp, nil
+	}
+	status, err := remote.GetPodSandboxStatus(ctx, c.remoteCRI.RuntimeService, sandboxId)
+	if err != nil {
+		return "", err
+	}
+	ip := handleNetworkIp(&PodStatus{status: status})
+	if ip == "" {
+		return "", fmt.Errorf("pod sandbox %s has no ip", sandboxId)
+	}
+	return ip, nil
+}
+
+// resolveProbePort 解析探针的端口，字符串时按照容器端口名称查找
+func resolveProbePort(port intstr.IntOrString, container *v1.Container) (int, error) {
+	if port.Type == intstr.Int {
+		return port.IntValue(), nil
+	}
+	for _, p := range container.Ports {
+		if p.Name == port.StrVal {
+			return int(p.ContainerPort), nil
+		}
+	}
+	if n, err := strconv.Atoi(port.StrVal); err == nil {
+		return n, nil
+	}
+	return 0, fmt.Errorf("couldn't find port %q in container %s", port.StrVal, container.Name)
+}
+
+// int32OrDefault 探针中未设置的字段使用默认值
+func int32OrDefault(v int32, def int32) int32 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// truncateProbeOutput 截断探针输出，避免事件过长
+func truncateProbeOutput(output string) string {
+	if len(output) > maxProbeOutput {
+		return output[:maxProbeOutput]
+	}
+	return output
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
 )
@@ -26,6 +27,10 @@ func (c *CriProvider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
 	klog.Info("更新pod请求")
 	// FIXME: 可能会有些问题，使用kubectl apply xxx 相当于create创建新pod
 	if pod.Annotations != nil && pod.Annotations["type"] == "bash" {
+		// 已经运行的pod不重新创建，否则会停止并重启所有命令
+		if c.PodManager.isSamplePod(pod.UID) {
+			return nil
+		}
 		return c.createSamplePod(ctx, pod)
 	}
 	return nil
@@ -63,12 +68,31 @@ func (c *CriProvider) GetPods(ctx context.Context) ([]*v1.Pod, error) {
 // GetContainerLogs 获取容器日志
 func (c *CriProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
 	klog.Infof("获取pod name: %s namespace: %s container name: %s 日志", podName, namespace, containerName)
-	return nil, nil
+	return c.getContainerLogs(ctx, namespace, podName, containerName, opts)
 }
 
 // RunInContainer 执行pod中的容器逻辑
 func (c *CriProvider) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
-	return nil
+	klog.Infof("在pod name: %s namespace: %s container name: %s 中执行命令: %v", podName, namespace, containerName, cmd)
+	return c.runInContainer(ctx, namespace, podName, containerName, cmd, attach)
+}
+
+// AttachToContainer 准备attach到pod中的容器，返回CRI streaming server的url
+func (c *CriProvider) AttachToContainer(ctx context.Context, namespace, podName, containerName string, opts StreamOptions) (string, error) {
+	klog.Infof("attach到pod name: %s namespace: %s container name: %s", podName, namespace, containerName)
+	return c.attachToContainer(ctx, namespace, podName, containerName, opts)
+}
+
+// PortForward 准备转发pod的端口，返回CRI streaming server的url
+func (c *CriProvider) PortForward(ctx context.Context, namespace, podName string) (string, error) {
+	klog.Infof("转发pod name: %s namespace: %s 的端口", podName, namespace)
+	return c.portForward(ctx, namespace, podName)
+}
+
+// GetStatsSummary 获取节点与pod的资源使用情况
+func (c *CriProvider) GetStatsSummary(ctx context.Context) (*statsv1alpha1.Summary, error) {
+	klog.Infof("获取节点资源使用情况")
+	return c.getStatsSummary(ctx)
 }
 
 // ConfigureNode 初始化自定义node节点信息
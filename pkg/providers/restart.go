@@ -0,0 +1,441 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// 与kubelet一致，重启的退避时间从10s开始翻倍，最长5分钟
+	restartBackOffInitial = 10 * time.Second
+	restartBackOffMax     = 300 * time.Second
+	// supervisorPeriod 检查容器状态的周期
+	supervisorPeriod = 2 * time.Second
+
+	// reasonCrashLoopBackOff 容器处于重启退避中
+	reasonCrashLoopBackOff = "CrashLoopBackOff"
+	// eventBackOff 容器重启退避的事件
+	eventBackOff = "BackOff"
+)
+
+// podRuntime 创建与重建容器需要的pod上下文
+type podRuntime struct {
+	// pod 填充了podIP与hostIP的pod
+	pod           *v1.Pod
+	sandboxId     string
+	sandboxConfig *criapi.PodSandboxConfig
+	// volumes volume名称与宿主机路径的对应关系
+	volumes      map[string]string
+	etcHostsPath string
+	// volumeErr pod中有无法挂载的volume，不为nil时不创建容器
+	volumeErr error
+}
+
+// startContainer 创建并启动容器，attempt为容器的重启次数
+func (c *CriProvider) startContainer(ctx context.Context, rt *podRuntime, spec *v1.Container, attempt uint32) (string, error) {
+	pod := rt.pod
+	if rt.volumeErr != nil {
+		return "", rt.volumeErr
+	}
+	cs := *spec
+	// 解析环境变量，并展开command与args中的$(VAR)
+	envs, err := c.makeEnvironmentVariables(pod, &cs)
+	if err != nil {
+		klog.Error("makeEnvironmentVariables err: ", err)
+		return "", err
+	}
+	cs.Env = envs
+	expandContainerCommand(&cs, envs)
+	expandVolumeMounts(&cs, envs)
+
+	// 按照imagePullPolicy确保镜像存在，需要拉取时在后台拉取
+	imageRef, err := c.ensureImageExists(ctx, pod, &cs)
+	if err != nil {
+		klog.Errorf("image of container %s not ready: %s", cs.Name, err)
+		return "", err
+	}
+	// 检查runAsNonRoot等需要结合镜像判断的配置
+	err = c.verifyContainerSecurityContext(ctx, pod, &cs, imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	klog.Infof("Creating container %s attempt %d", cs.Name, attempt)
+	// 生成容器配置文件，oom_score_adj按照节点的内存容量计算
+	capacity := c.nodeCapacity()
+	cConfig, err := remote.GenerateContainerConfig(ctx, &cs, pod, imageRef, rt.volumes, rt.etcHostsPath, attempt, capacity.Memory().Value())
+	if err != nil {
+		klog.Error("GenerateContainerConfig err: ", err)
+		return "", err
+	}
+	// 创建容器
+	cId, err := remote.CreateContainer(ctx, c.remoteCRI.RuntimeService, cConfig, rt.sandboxConfig, rt.sandboxId)
+	if err != nil {
+		klog.Error("CreateContainer err: ", err)
+		return "", err
+	}
+
+	klog.Infof("Starting container %s", cs.Name)
+	// 运行容器
+	err = remote.StartContainer(context.Background(), c.remoteCRI.RuntimeService, cId)
+	if err != nil {
+		klog.Error("StartContainer err: ", err)
+		return "", err
+	}
+	// 执行postStart，失败时容器会被停止，之后按照restartPolicy重启
+	err = c.runPostStartHook(ctx, rt.sandboxId, pod, &cs, cId)
+	if err != nil {
+		klog.Error("runPostStartHook err: ", err)
+		return "", err
+	}
+	return cId, nil
+}
+
+// podSupervisor 定时检查pod中的容器，按照restartPolicy重启退出的容器
+type podSupervisor struct {
+	runtime *podRuntime
+	cancel  context.CancelFunc
+
+	mu sync.Mutex
+	// waiting 处于退避中的容器的等待原因
+	waiting map[string]*v1.ContainerStateWaiting
+	// backOffContainer 已经记录过退避事件的容器id，避免重复记录
+	backOffContainer map[string]string
+	// pendingRestart 已经计入退避、等待镜像拉取的重启及其attempt，镜像可用后直接创建，不再计入退避
+	pendingRestart map[string]uint32
+}
+
+// startSupervisor 启动pod的supervisor，已经存在时替换为新的上下文，waiting为容器初始的等待原因
+func (c *CriProvider) startSupervisor(rt *podRuntime, waiting map[string]*v1.ContainerStateWaiting) {
+	ctx, s := c.registerSupervisor(rt)
+	for name, w := range waiting {
+		s.setWaiting(name, w)
+	}
+	go c.runSupervisor(ctx, s)
+}
+
+// registerSupervisor 记录pod的supervisor并返回其上下文，pod删除时上下文结束。
+// 简易pod的容器进程由自己的goroutine重启，只使用返回的上下文
+func (c *CriProvider) registerSupervisor(rt *podRuntime) (context.Context, *podSupervisor) {
+	c.supervisorsMu.Lock()
+	defer c.supervisorsMu.Unlock()
+	if old, ok := c.supervisors[rt.pod.UID]; ok {
+		old.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &podSupervisor{
+		runtime:          rt,
+		cancel:           cancel,
+		waiting:          map[string]*v1.ContainerStateWaiting{},
+		backOffContainer: map[string]string{},
+		pendingRestart:   map[string]uint32{},
+	}
+	c.supervisors[rt.pod.UID] = s
+	return ctx, s
+}
+
+// stopSupervisor 停止pod的supervisor，并清除容器的退避记录
+func (c *CriProvider) stopSupervisor(uid types.UID) {
+	c.supervisorsMu.Lock()
+	s, ok := c.supervisors[uid]
+	delete(c.supervisors, uid)
+	c.supervisorsMu.Unlock()
+	if !ok {
+		return
+	}
+	s.cancel()
+	for _, containers := range [][]v1.Container{s.runtime.pod.Spec.InitContainers, s.runtime.pod.Spec.Containers} {
+		for _, container := range containers {
+			c.restartBackOff.DeleteEntry(restartBackOffKey(s.runtime.pod, container.Name))
+		}
+	}
+	c.forgetImagePulls(s.runtime.pod)
+}
+
+// containerWaiting 返回pod中处于退避中的容器
+func (c *CriProvider) containerWaiting(uid types.UID) map[string]*v1.ContainerStateWaiting {
+	c.supervisorsMu.Lock()
+	s, ok := c.supervisors[uid]
+	c.supervisorsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting := make(map[string]*v1.ContainerStateWaiting, len(s.waiting))
+	for name, w := range s.waiting {
+		waiting[name] = w.DeepCopy()
+	}
+	return waiting
+}
+
+// runSupervisor 定时同步容器状态，ctx结束时退出
+func (c *CriProvider) runSupervisor(ctx context.Context, s *podSupervisor) {
+	ticker := time.NewTicker(supervisorPeriod)
+	defer ticker.Stop()
+	for {
+		if err := c.syncPodContainers(ctx, s); err != nil && ctx.Err() == nil {
+			klog.Errorf("sync containers of pod %s/%s err: %s", s.runtime.pod.Namespace, s.runtime.pod.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncPodContainers 依次运行init容器，全部成功后创建应用容器，并按照restartPolicy重启退出的容器
+func (c *CriProvider) syncPodContainers(ctx context.Context, s *podSupervisor) error {
+	rt := s.runtime
+	pod := rt.pod
+	containers, err := remote.GetContainersForSandbox(ctx, c.remoteCRI.RuntimeService, rt.sandboxId)
+	if err != nil {
+		return err
+	}
+	byName := groupContainersByName(containers)
+
+	initialized, changed, err := c.syncInitContainers(ctx, s, byName)
+	if err != nil {
+		return err
+	}
+	if initialized {
+		for i := range pod.Spec.Containers {
+			spec := &pod.Spec.Containers[i]
+			containerChanged, err := c.syncContainer(ctx, s, spec, byName[spec.Name], pod.Spec.RestartPolicy)
+			if err != nil {
+				return err
+			}
+			changed = changed || containerChanged
+		}
+	}
+
+	if changed {
+		return c.notifyPodChanged(ctx, pod)
+	}
+	return nil
+}
+
+// syncInitContainers 按顺序运行init容器，前一个成功退出后才运行下一个，返回是否全部完成。
+// init容器失败时，除了restartPolicy为Never都会重启
+func (c *CriProvider) syncInitContainers(ctx context.Context, s *podSupervisor, byName map[string][]*criapi.Container) (bool, bool, error) {
+	pod := s.runtime.pod
+	policy := v1.RestartPolicyOnFailure
+	if pod.Spec.RestartPolicy == v1.RestartPolicyNever {
+		policy = v1.RestartPolicyNever
+	}
+	for i := range pod.Spec.InitContainers {
+		spec := &pod.Spec.InitContainers[i]
+		attempts := byName[spec.Name]
+		if len(attempts) > 0 && attempts[0].State == criapi.ContainerState_CONTAINER_EXITED {
+			status, err := remote.GetContainerCRIStatus(ctx, c.remoteCRI.RuntimeService, attempts[0].Id)
+			if err != nil {
+				return false, false, err
+			}
+			if status.ExitCode == 0 {
+				continue
+			}
+		}
+		changed, err := c.syncContainer(ctx, s, spec, attempts, policy)
+		return false, changed, err
+	}
+	return true, false, nil
+}
+
+// syncContainer 创建还不存在的容器，容器退出后按照policy与退避时间重启，返回状态是否有变化
+func (c *CriProvider) syncContainer(ctx context.Context, s *podSupervisor, spec *v1.Container, attempts []*criapi.Container, policy v1.RestartPolicy) (bool, error) {
+	pod := s.runtime.pod
+	if len(attempts) == 0 {
+		// 创建失败(如引用的configMap不存在、runAsNonRoot检查失败)与重启使用相同的退避，退避期间保持上一次的等待原因
+		key := restartBackOffKey(pod, spec.Name)
+		now := c.restartBackOff.Clock.Now()
+		if c.restartBackOff.IsInBackOffSinceUpdate(key, now) {
+			return false, nil
+		}
+		if _, err := c.startContainer(ctx, s.runtime, spec, 0); err != nil {
+			if !isContainerWaitingError(err) {
+				c.restartBackOff.Next(key, now)
+				c.recordEvent(pod, v1.EventTypeWarning, eventFailed, "Error: %v", err)
+			}
+			return s.setWaiting(spec.Name, containerWaitingForError(err)), nil
+		}
+		s.setWaiting(spec.Name, nil)
+		return true, nil
+	}
+	if attempt, ok := s.pendingRestartAttempt(spec.Name); ok {
+		return c.restartContainer(ctx, s, spec, attempt), nil
+	}
+	latest := attempts[0]
+	// 需要删除的旧容器与新容器的attempt
+	removed, attempt := attempts[1:], latest.Metadata.Attempt+1
+	var failedAt time.Time
+	switch latest.State {
+	case criapi.ContainerState_CONTAINER_RUNNING:
+		return s.setWaiting(spec.Name, nil), nil
+	case criapi.ContainerState_CONTAINER_EXITED:
+		status, err := remote.GetContainerCRIStatus(ctx, c.remoteCRI.RuntimeService, latest.Id)
+		if err != nil {
+			return false, err
+		}
+		if !shouldRestartContainer(policy, status.ExitCode) {
+			return s.setWaiting(spec.Name, nil), nil
+		}
+		failedAt = time.Unix(0, status.FinishedAt)
+	default:
+		// CREATED或UNKNOWN：StartContainer或postStart失败后容器不会再运行，按启动失败处理，
+		// 删除后以相同的attempt重建，保留上一次退出的容器
+		if !shouldRestartContainer(policy, 1) {
+			return false, nil
+		}
+		failedAt = time.Unix(0, latest.CreatedAt)
+		removed, attempt = []*criapi.Container{latest}, latest.Metadata.Attempt
+		if len(attempts) > 2 {
+			removed = append(removed, attempts[2:]...)
+		}
+	}
+
+	key := restartBackOffKey(pod, spec.Name)
+	if c.restartBackOff.IsInBackOffSince(key, failedAt) {
+		message := fmt.Sprintf("back-off %s restarting failed container=%s pod=%s_%s(%s)",
+			c.restartBackOff.Get(key), spec.Name, pod.Name, pod.Namespace, pod.UID)
+		changed := s.setWaiting(spec.Name, &v1.ContainerStateWaiting{Reason: reasonCrashLoopBackOff, Message: message})
+		if s.markBackOff(spec.Name, latest.Id) {
+			c.recordEvent(pod, v1.EventTypeWarning, eventBackOff, "Back-off restarting failed container %s", spec.Name)
+		}
+		return changed, nil
+	}
+	c.restartBackOff.Next(key, failedAt)
+
+	// 只保留上一次退出的容器，用于lastState与kubectl logs --previous
+	for _, old := range removed {
+		if err := remote.RemoveContainer(ctx, c.remoteCRI.RuntimeService, old.Id); err != nil {
+			klog.Errorf("remove container %s err: %s", old.Id, err)
+		}
+	}
+	klog.Infof("restarting container %s of pod %s/%s, attempt %d", spec.Name, pod.Namespace, pod.Name, attempt)
+	return c.restartContainer(ctx, s, spec, attempt), nil
+}
+
+// restartContainer 以attempt重建容器，返回状态是否有变化。
+// 镜像还不能使用时记录为等待中的重启，之后的同步只重试创建，不会重复计入重启退避
+func (c *CriProvider) restartContainer(ctx context.Context, s *podSupervisor, spec *v1.Container, attempt uint32) bool {
+	_, err := c.startContainer(ctx, s.runtime, spec, attempt)
+	if _, ok := err.(*imagePullError); ok {
+		s.setPendingRestart(spec.Name, attempt, true)
+		return s.setWaiting(spec.Name, containerWaitingForError(err))
+	}
+	// 其他错误按照重启失败处理，下次同步时重新检查退避
+	s.setPendingRestart(spec.Name, 0, false)
+	if err != nil {
+		c.recordEvent(s.runtime.pod, v1.EventTypeWarning, eventFailed, "Error: %v", err)
+		s.setWaiting(spec.Name, containerWaitingForError(err))
+		return true
+	}
+	s.setWaiting(spec.Name, nil)
+	return true
+}
+
+// notifyPodChanged 容器状态变化后，刷新状态并立即上报，不必等待下一次定时检查
+func (c *CriProvider) notifyPodChanged(ctx context.Context, pod *v1.Pod) error {
+	if c.notifyStatus == nil {
+		return nil
+	}
+	if err := c.refreshNodeState(ctx); err != nil {
+		return err
+	}
+	if ps := c.findPodByName(pod.Namespace, pod.Name); ps != nil {
+		c.notifyStatus(createPodSpecFromCRI(ps, c.nodeName))
+	}
+	return nil
+}
+
+// setWaiting 设置容器的等待原因，nil表示清除，返回是否有变化
+func (s *podSupervisor) setWaiting(name string, waiting *v1.ContainerStateWaiting) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.waiting[name]
+	if waiting == nil {
+		delete(s.waiting, name)
+		return ok
+	}
+	s.waiting[name] = waiting
+	return !ok || old.Reason != waiting.Reason || old.Message != waiting.Message
+}
+
+// markBackOff 记录容器的某次退出已经发送过退避事件，返回是否为第一次记录
+func (s *podSupervisor) markBackOff(name string, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.backOffContainer[name]; ok && last == id {
+		return false
+	}
+	s.backOffContainer[name] = id
+	return true
+}
+
+// pendingRestartAttempt 返回等待镜像拉取的重启的attempt
+func (s *podSupervisor) pendingRestartAttempt(name string) (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt, ok := s.pendingRestart[name]
+	return attempt, ok
+}
+
+// setPendingRestart 记录或清除等待镜像拉取的重启
+func (s *podSupervisor) setPendingRestart(name string, attempt uint32, pending bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pending {
+		s.pendingRestart[name] = attempt
+	} else {
+		delete(s.pendingRestart, name)
+	}
+}
+
+// shouldRestartContainer 按照restartPolicy判断退出的容器是否需要重启
+func shouldRestartContainer(policy v1.RestartPolicy, exitCode int32) bool {
+	switch policy {
+	case v1.RestartPolicyNever:
+		return false
+	case v1.RestartPolicyOnFailure:
+		return exitCode != 0
+	}
+	return true
+}
+
+// restartBackOffKey 容器重启退避的key
+func restartBackOffKey(pod *v1.Pod, containerName string) string {
+	return fmt.Sprintf("%s_%s_%s_%s", pod.Name, pod.Namespace, pod.UID, containerName)
+}
+
+// newRestartBackOff 创建容器重启的退避记录
+func newRestartBackOff() *flowcontrol.Backoff {
+	return flowcontrol.NewBackOff(restartBackOffInitial, restartBackOffMax)
+}
+
+// groupContainersByName 按照容器名称分组，每组按照attempt从大到小排序
+func groupContainersByName(containers []*criapi.Container) map[string][]*criapi.Container {
+	byName := make(map[string][]*criapi.Container)
+	for _, container := range containers {
+		if container.Metadata == nil {
+			continue
+		}
+		byName[container.Metadata.Name] = append(byName[container.Metadata.Name], container)
+	}
+	for _, attempts := range byName {
+		sort.Slice(attempts, func(i, j int) bool {
+			return attempts[i].Metadata.Attempt > attempts[j].Metadata.Attempt
+		})
+	}
+	return byName
+}
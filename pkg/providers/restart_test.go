@@ -0,0 +1,29 @@
+package providers
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestShouldRestartContainer(t *testing.T) {
+	tests := []struct {
+		policy   v1.RestartPolicy
+		exitCode int32
+		want     bool
+	}{
+		{policy: v1.RestartPolicyAlways, exitCode: 0, want: true},
+		{policy: v1.RestartPolicyAlways, exitCode: 1, want: true},
+		{policy: v1.RestartPolicyOnFailure, exitCode: 0, want: false},
+		{policy: v1.RestartPolicyOnFailure, exitCode: 137, want: true},
+		{policy: v1.RestartPolicyNever, exitCode: 0, want: false},
+		{policy: v1.RestartPolicyNever, exitCode: 1, want: false},
+		// 没有设置时与Always一致
+		{policy: "", exitCode: 0, want: true},
+	}
+	for _, tt := range tests {
+		if got := shouldRestartContainer(tt.policy, tt.exitCode); got != tt.want {
+			t.Errorf("shouldRestartContainer(%q, %d) = %v, want %v", tt.policy, tt.exitCode, got, tt.want)
+		}
+	}
+}
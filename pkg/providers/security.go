@@ -0,0 +1,116 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// selinuxMountPath 宿主机启用SELinux时存在此目录
+const selinuxMountPath = "/sys/fs/selinux"
+
+// safeSysctls 与kubelet默认允许的sysctl一致，其他sysctl会被拒绝
+var safeSysctls = map[string]bool{
+	"kernel.shm_rmid_forced":              true,
+	"net.ipv4.ip_local_port_range":        true,
+	"net.ipv4.tcp_syncookies":             true,
+	"net.ipv4.ping_group_range":           true,
+	"net.ipv4.ip_unprivileged_port_start": true,
+}
+
+// validatePodSecurityContext 检查pod级别的securityContext在本节点上能否生效，
+// 不能生效时返回事件的reason与错误，避免pod以更宽松的限制运行
+func validatePodSecurityContext(pod *v1.Pod) (string, error) {
+	psc := pod.Spec.SecurityContext
+	if psc != nil {
+		for _, sysctl := range psc.Sysctls {
+			if !safeSysctls[sysctl.Name] {
+				return eventSysctlForbidden, errdefs.InvalidInputf("forbidden sysctl: %q not allowlisted", sysctl.Name)
+			}
+			// 使用宿主机namespace时，设置sysctl会影响整个节点
+			if pod.Spec.HostNetwork && strings.HasPrefix(sysctl.Name, "net.") {
+				return eventSysctlForbidden, errdefs.InvalidInputf("sysctl %q not allowed with hostNetwork", sysctl.Name)
+			}
+			if pod.Spec.HostIPC && isIPCSysctl(sysctl.Name) {
+				return eventSysctlForbidden, errdefs.InvalidInputf("sysctl %q not allowed with hostIPC", sysctl.Name)
+			}
+		}
+		if psc.SELinuxOptions != nil && !selinuxEnabled() {
+			return eventSecurityContextForbidden, errdefs.InvalidInput("seLinuxOptions is set but SELinux is not enabled on the node")
+		}
+	}
+
+	profile, err := remote.PodSeccompProfile(pod)
+	if err != nil {
+		return eventSecurityContextForbidden, err
+	}
+	if profile.ProfileType == criapi.SecurityProfile_Localhost {
+		if _, err = os.Stat(profile.LocalhostRef); err != nil {
+			return eventSecurityContextForbidden, errdefs.InvalidInputf("seccomp profile %s could not be loaded: %v", profile.LocalhostRef, err)
+		}
+	}
+	return "", nil
+}
+
+// isIPCSysctl 属于ipc namespace的sysctl
+func isIPCSysctl(name string) bool {
+	switch name {
+	case "kernel.sem":
+		return true
+	}
+	return strings.HasPrefix(name, "kernel.shm") || strings.HasPrefix(name, "kernel.msg") || strings.HasPrefix(name, "fs.mqueue.")
+}
+
+// selinuxEnabled 宿主机是否启用了SELinux
+func selinuxEnabled() bool {
+	_, err := os.Stat(selinuxMountPath)
+	return err == nil
+}
+
+// verifyContainerSecurityContext 检查容器级别的securityContext能否生效，imageRef为已拉取的镜像
+func (c *CriProvider) verifyContainerSecurityContext(ctx context.Context, pod *v1.Pod, container *v1.Container, imageRef string) error {
+	csc := container.SecurityContext
+	if csc != nil && csc.SELinuxOptions != nil && !selinuxEnabled() {
+		return errdefs.InvalidInput("seLinuxOptions is set but SELinux is not enabled on the node")
+	}
+	if csc != nil && csc.SeccompProfile != nil && csc.SeccompProfile.Type == v1.SeccompProfileTypeLocalhost &&
+		csc.SeccompProfile.LocalhostProfile != nil {
+		path := filepath.Join(remote.SeccompProfileRoot, *csc.SeccompProfile.LocalhostProfile)
+		if _, err := os.Stat(path); err != nil {
+			return errdefs.InvalidInputf("seccomp profile %s could not be loaded: %v", path, err)
+		}
+	}
+
+	if !remote.EffectiveRunAsNonRoot(container, pod) {
+		return nil
+	}
+	if uid := remote.EffectiveRunAsUser(container, pod); uid != nil {
+		if *uid == 0 {
+			return errdefs.InvalidInput("container's runAsUser breaks non-root policy")
+		}
+		return nil
+	}
+	// 没有指定uid时，需要检查镜像中的用户
+	image, err := remote.ImageStatus(ctx, c.remoteCRI.ImageService, imageRef)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return errdefs.NotFoundf("image %s could not be found", imageRef)
+	}
+	switch {
+	case image.Uid != nil && image.Uid.Value == 0:
+		return errdefs.InvalidInput("container has runAsNonRoot and image will run as root")
+	case image.Uid == nil && image.Username != "":
+		return errdefs.InvalidInputf("container has runAsNonRoot and image has non-numeric user (%s), cannot verify user is non-root", image.Username)
+	case image.Uid == nil:
+		return errdefs.InvalidInput("container has runAsNonRoot and image will run as root")
+	}
+	return nil
+}
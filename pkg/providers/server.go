@@ -0,0 +1,122 @@
+package providers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// attachPath kubectl attach的路由：/attach/{namespace}/{pod}/{container}
+	attachPath = "/attach/"
+	// portForwardPath kubectl port-forward的路由：/portForward/{namespace}/{pod}
+	portForwardPath = "/portForward/"
+)
+
+// StreamOptions attach时需要建立的stream，与kubelet相同从请求参数中获取
+type StreamOptions struct {
+	Stdin  bool
+	Stdout bool
+	Stderr bool
+	TTY    bool
+}
+
+// PodHandler 生成kubelet API的handler。
+// exec、logs、pods与stats使用virtual-kubelet的路由，node-cli没有注册的attach与portForward
+// 由CRI streaming server处理，请求会被转发到CRI返回的url
+func (c *CriProvider) PodHandler(streamIdleTimeout, streamCreationTimeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	api.AttachPodRoutes(api.PodHandlerConfig{
+		RunInContainer:        c.RunInContainer,
+		GetContainerLogs:      c.GetContainerLogs,
+		GetPods:               c.GetPods,
+		GetStatsSummary:       c.GetStatsSummary,
+		StreamIdleTimeout:     streamIdleTimeout,
+		StreamCreationTimeout: streamCreationTimeout,
+	}, mux, true)
+	mux.Handle(attachPath, handleStreamError(c.handleAttach))
+	mux.Handle(portForwardPath, handleStreamError(c.handlePortForward))
+	return mux
+}
+
+// handleAttach 处理kubectl attach请求
+func (c *CriProvider) handleAttach(w http.ResponseWriter, req *http.Request) error {
+	params, ok := pathParams(req.URL.Path, attachPath, 3)
+	if !ok {
+		return errdefs.InvalidInputf("invalid attach path %s", req.URL.Path)
+	}
+	query := req.URL.Query()
+	opts := StreamOptions{
+		Stdin:  query.Get(v1.ExecStdinParam) == "1",
+		Stdout: query.Get(v1.ExecStdoutParam) == "1",
+		Stderr: query.Get(v1.ExecStderrParam) == "1",
+		TTY:    query.Get(v1.ExecTTYParam) == "1",
+	}
+	if !opts.Stdin && !opts.Stdout && !opts.Stderr {
+		return errdefs.InvalidInput("you must specify at least 1 of stdin, stdout, stderr")
+	}
+
+	url, err := c.AttachToContainer(req.Context(), params[0], params[1], params[2], opts)
+	if err != nil {
+		return err
+	}
+	return remote.ProxyStream(w, req, url)
+}
+
+// handlePortForward 处理kubectl port-forward请求
+func (c *CriProvider) handlePortForward(w http.ResponseWriter, req *http.Request) error {
+	params, ok := pathParams(req.URL.Path, portForwardPath, 2)
+	if !ok {
+		return errdefs.InvalidInputf("invalid port-forward path %s", req.URL.Path)
+	}
+
+	url, err := c.PortForward(req.Context(), params[0], params[1])
+	if err != nil {
+		return err
+	}
+	return remote.ProxyStream(w, req, url)
+}
+
+// pathParams 按"/"拆分路由前缀之后的路径，路径段数量需要与n相同且都不为空
+func pathParams(path, prefix string, n int) ([]string, bool) {
+	params := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	if len(params) != n {
+		return nil, false
+	}
+	for _, p := range params {
+		if p == "" {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// handleStreamError 与virtual-kubelet的路由相同，把errdefs错误转换为http状态码
+func handleStreamError(f func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := f(w, req)
+		if err == nil {
+			return
+		}
+		code := streamStatusCode(err)
+		klog.Errorf("处理 %s 请求失败, 状态码: %d, err: %v", req.URL.Path, code, err)
+		http.Error(w, err.Error(), code)
+	})
+}
+
+func streamStatusCode(err error) int {
+	switch {
+	case errdefs.IsNotFound(err):
+		return http.StatusNotFound
+	case errdefs.IsInvalidInput(err):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,29 @@
+package providers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPathParams(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		n      int
+		want   []string
+		wantOk bool
+	}{
+		{path: "/attach/default/nginx/web", prefix: attachPath, n: 3, want: []string{"default", "nginx", "web"}, wantOk: true},
+		{path: "/portForward/default/nginx", prefix: portForwardPath, n: 2, want: []string{"default", "nginx"}, wantOk: true},
+		{path: "/attach/default/nginx", prefix: attachPath, n: 3},
+		{path: "/attach/default/nginx/uid/web", prefix: attachPath, n: 3},
+		{path: "/attach/default//web", prefix: attachPath, n: 3},
+		{path: "/portForward/default/nginx/", prefix: portForwardPath, n: 2},
+	}
+	for _, tt := range tests {
+		got, ok := pathParams(tt.path, tt.prefix, tt.n)
+		if ok != tt.wantOk || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pathParams(%q) = %v, %v, want %v, %v", tt.path, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
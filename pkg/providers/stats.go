@@ -0,0 +1,391 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/helper"
+	"github.com/practice/virtual-kubelet-practice/pkg/remote"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodeCPUUsageKey 节点cpu使用在cpuUsageCache中的key
+	nodeCPUUsageKey = "node"
+	// cpuUsageCacheTTL 超过此时间没有更新的cpu采样会被清理
+	cpuUsageCacheTTL = 5 * time.Minute
+)
+
+// cpuSample 一次cpu累计使用时间的采样
+type cpuSample struct {
+	usage     uint64
+	timestamp int64
+	updated   time.Time
+}
+
+// cpuUsageCache 记录上一次采集的cpu累计使用时间，用于计算UsageNanoCores
+type cpuUsageCache struct {
+	mu      sync.Mutex
+	samples map[string]cpuSample
+}
+
+func newCPUUsageCache() *cpuUsageCache {
+	return &cpuUsageCache{samples: map[string]cpuSample{}}
+}
+
+// nanoCores 记录本次采样，并由两次采样的差值计算平均使用的核数(纳核)，第一次采样时返回nil
+func (cu *cpuUsageCache) nanoCores(key string, usage uint64, timestamp int64) *uint64 {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	prev, ok := cu.samples[key]
+	cu.samples[key] = cpuSample{usage: usage, timestamp: timestamp, updated: time.Now()}
+	if !ok || timestamp <= prev.timestamp || usage < prev.usage {
+		return nil
+	}
+	v := uint64(float64(usage-prev.usage) / float64(timestamp-prev.timestamp) * float64(time.Second))
+	return &v
+}
+
+// prune 清理已经不存在的容器的采样
+func (cu *cpuUsageCache) prune(before time.Time) {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	for key, s := range cu.samples {
+		if s.updated.Before(before) {
+			delete(cu.samples, key)
+		}
+	}
+}
+
+// getStatsSummary 获取节点、pod与容器的资源使用情况
+func (c *CriProvider) getStatsSummary(ctx context.Context) (*statsv1alpha1.Summary, error) {
+	// 刷新node中pod状态
+	err := c.refreshNodeState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	criStats, err := remote.ListContainerStats(ctx, c.remoteCRI.RuntimeService, &criapi.ContainerStatsFilter{})
+	if err != nil {
+		return nil, err
+	}
+	statsById := make(map[string]*criapi.ContainerStats, len(criStats))
+	for _, st := range criStats {
+		if st.Attributes != nil {
+			statsById[st.Attributes.Id] = st
+		}
+	}
+
+	now := time.Now()
+	summary := &statsv1alpha1.Summary{
+		Node: c.nodeStats(ctx, now),
+	}
+	for _, ps := range c.PodManager.getPodStatus() {
+		ps := ps
+		summary.Pods = append(summary.Pods, c.criPodStats(ctx, &ps, statsById, now))
+	}
+	if samplePods := c.PodManager.getSamplePodStatus(); len(samplePods) > 0 {
+		// 简易pod的容器进程可能创建子进程，需要按进程树统计
+		procs, err := helper.ReadAllProcStats()
+		if err != nil {
+			klog.Warning("read process stats err: ", err)
+		}
+		for _, ps := range samplePods {
+			ps := ps
+			summary.Pods = append(summary.Pods, c.samplePodStats(&ps, procs, now))
+		}
+	}
+	c.cpuUsage.prune(now.Add(-cpuUsageCacheTTL))
+	return summary, nil
+}
+
+// nodeStats 由/proc与文件系统信息生成节点的资源使用情况
+func (c *CriProvider) nodeStats(ctx context.Context, now time.Time) statsv1alpha1.NodeStats {
+	ts := metav1.NewTime(now)
+	ns := statsv1alpha1.NodeStats{
+		NodeName: c.nodeName,
+	}
+	if bootTime, err := helper.ReadBootTime(); err == nil {
+		ns.StartTime = metav1.NewTime(bootTime)
+	}
+	if usage, err := helper.ReadNodeCPUTime(); err == nil {
+		ns.CPU = &statsv1alpha1.CPUStats{
+			Time:                 ts,
+			UsageCoreNanoSeconds: &usage,
+			UsageNanoCores:       c.cpuUsage.nanoCores(nodeCPUUsageKey, usage, now.UnixNano()),
+		}
+	} else {
+		klog.Warning("read node cpu usage err: ", err)
+	}
+	if total, available, err := helper.ReadMemInfo(); err == nil {
+		used := total - available
+		ns.Memory = &statsv1alpha1.MemoryStats{
+			Time:            ts,
+			AvailableBytes:  &available,
+			UsageBytes:      &used,
+			WorkingSetBytes: &used,
+		}
+	} else {
+		klog.Warning("read node memory usage err: ", err)
+	}
+	ns.Fs = fsStats(c.podVolRoot, now)
+
+	imageFs, err := remote.ImageFsInfo(ctx, c.remoteCRI.ImageService)
+	if err != nil {
+		klog.Warning("ImageFsInfo err: ", err)
+		return ns
+	}
+	if len(imageFs) > 0 {
+		fs := &statsv1alpha1.FsStats{
+			Time:       metav1.NewTime(time.Unix(0, imageFs[0].Timestamp)),
+			UsedBytes:  criUint64(imageFs[0].UsedBytes),
+			InodesUsed: criUint64(imageFs[0].InodesUsed),
+		}
+		if imageFs[0].FsId != nil {
+			if info, err := helper.GetFsInfo(imageFs[0].FsId.Mountpoint); err == nil {
+				fs.CapacityBytes = &info.CapacityBytes
+				fs.AvailableBytes = &info.AvailableBytes
+				fs.Inodes = &info.Inodes
+				fs.InodesFree = &info.InodesFree
+			}
+		}
+		ns.Runtime = &statsv1alpha1.RuntimeStats{ImageFs: fs}
+	}
+	return ns
+}
+
+// criPodStats 由CRI的容器统计信息生成pod的资源使用情况
+func (c *CriProvider) criPodStats(ctx context.Context, ps *PodStatus, statsById map[string]*criapi.ContainerStats, now time.Time) statsv1alpha1.PodStats {
+	podStats := newPodStats(ps)
+	logDir := filepath.Join(c.podLogRoot, ps.status.Metadata.Uid)
+	for name, cs := range ps.containers {
+		// 与kubelet相同，只统计运行中的容器
+		if cs.State != criapi.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		st, ok := statsById[cs.Id]
+		if !ok {
+			var err error
+			st, err = remote.GetContainerStats(ctx, c.remoteCRI.RuntimeService, cs.Id)
+			if err != nil {
+				klog.Warningf("get stats of container %s err: %s", cs.Id, err)
+				continue
+			}
+		}
+
+		cStats := statsv1alpha1.ContainerStats{
+			Name:      name,
+			StartTime: metav1.NewTime(time.Unix(0, cs.StartedAt)),
+			Logs:      logsStats(logDir, name, now),
+		}
+		if st.Cpu != nil {
+			cStats.CPU = &statsv1alpha1.CPUStats{
+				Time:                 metav1.NewTime(time.Unix(0, st.Cpu.Timestamp)),
+				UsageCoreNanoSeconds: criUint64(st.Cpu.UsageCoreNanoSeconds),
+				UsageNanoCores:       criUint64(st.Cpu.UsageNanoCores),
+			}
+			// 运行时没有提供时，由两次采样计算
+			if cStats.CPU.UsageNanoCores == nil && cStats.CPU.UsageCoreNanoSeconds != nil {
+				cStats.CPU.UsageNanoCores = c.cpuUsage.nanoCores(cs.Id, *cStats.CPU.UsageCoreNanoSeconds, st.Cpu.Timestamp)
+			}
+		}
+		if st.Memory != nil {
+			cStats.Memory = &statsv1alpha1.MemoryStats{
+				Time:            metav1.NewTime(time.Unix(0, st.Memory.Timestamp)),
+				AvailableBytes:  criUint64(st.Memory.AvailableBytes),
+				UsageBytes:      criUint64(st.Memory.UsageBytes),
+				WorkingSetBytes: criUint64(st.Memory.WorkingSetBytes),
+				RSSBytes:        criUint64(st.Memory.RssBytes),
+				PageFaults:      criUint64(st.Memory.PageFaults),
+				MajorPageFaults: criUint64(st.Memory.MajorPageFaults),
+			}
+		}
+		if st.WritableLayer != nil {
+			cStats.Rootfs = &statsv1alpha1.FsStats{
+				Time:       metav1.NewTime(time.Unix(0, st.WritableLayer.Timestamp)),
+				UsedBytes:  criUint64(st.WritableLayer.UsedBytes),
+				InodesUsed: criUint64(st.WritableLayer.InodesUsed),
+			}
+		}
+		podStats.Containers = append(podStats.Containers, cStats)
+	}
+	aggregatePodStats(&podStats, now)
+	return podStats
+}
+
+// samplePodStats 由容器进程及其子孙进程的/proc/<pid>/stat生成简易pod的资源使用情况
+func (c *CriProvider) samplePodStats(ps *PodStatus, procs map[int]*helper.ProcStat, now time.Time) statsv1alpha1.PodStats {
+	podStats := newPodStats(ps)
+	logDir := filepath.Join(c.podLogRoot, ps.status.Metadata.Uid)
+	for name, cc := range ps.cmds {
+		cs, ok := ps.containers[name]
+		if !ok || cs.State != criapi.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		pid := cc.pid
+		if pid == 0 {
+			continue
+		}
+		stat, ok := helper.ProcTreeStat(procs, pid)
+		if !ok {
+			klog.Warningf("stats of process %d not found", pid)
+			continue
+		}
+		ts := metav1.NewTime(now)
+		podStats.Containers = append(podStats.Containers, statsv1alpha1.ContainerStats{
+			Name:      name,
+			StartTime: metav1.NewTime(time.Unix(0, cs.StartedAt)),
+			CPU: &statsv1alpha1.CPUStats{
+				Time:                 ts,
+				UsageCoreNanoSeconds: &stat.CPUTime,
+				UsageNanoCores:       c.cpuUsage.nanoCores(cs.Id, stat.CPUTime, now.UnixNano()),
+			},
+			Memory: &statsv1alpha1.MemoryStats{
+				Time:            ts,
+				UsageBytes:      &stat.RSSBytes,
+				WorkingSetBytes: &stat.RSSBytes,
+				RSSBytes:        &stat.RSSBytes,
+			},
+			Logs: logsStats(logDir, name, now),
+		})
+	}
+	aggregatePodStats(&podStats, now)
+	return podStats
+}
+
+func newPodStats(ps *PodStatus) statsv1alpha1.PodStats {
+	return statsv1alpha1.PodStats{
+		PodRef: statsv1alpha1.PodReference{
+			Name:      ps.status.Metadata.Name,
+			Namespace: ps.status.Metadata.Namespace,
+			UID:       ps.status.Metadata.Uid,
+		},
+		StartTime:  metav1.NewTime(time.Unix(0, ps.status.CreatedAt)),
+		Containers: []statsv1alpha1.ContainerStats{},
+	}
+}
+
+// aggregatePodStats 汇总容器的cpu、内存与临时存储使用量作为pod的使用量
+func aggregatePodStats(p *statsv1alpha1.PodStats, now time.Time) {
+	var (
+		nanoCores, coreNanoSeconds    uint64
+		usage, workingSet, rss, ephem uint64
+		hasCPU, hasMemory, hasEphem   bool
+		// allNanoCores 所有容器都有UsageNanoCores时才汇总，第一次采样时容器还没有该值
+		allNanoCores = true
+	)
+	for _, cs := range p.Containers {
+		if cs.CPU != nil {
+			hasCPU = true
+			if cs.CPU.UsageNanoCores == nil {
+				allNanoCores = false
+			}
+			nanoCores += valueOf(cs.CPU.UsageNanoCores)
+			coreNanoSeconds += valueOf(cs.CPU.UsageCoreNanoSeconds)
+		}
+		if cs.Memory != nil {
+			hasMemory = true
+			usage += valueOf(cs.Memory.UsageBytes)
+			workingSet += valueOf(cs.Memory.WorkingSetBytes)
+			rss += valueOf(cs.Memory.RSSBytes)
+		}
+		for _, fs := range []*statsv1alpha1.FsStats{cs.Rootfs, cs.Logs} {
+			if fs != nil && fs.UsedBytes != nil {
+				hasEphem = true
+				ephem += *fs.UsedBytes
+			}
+		}
+	}
+	ts := metav1.NewTime(now)
+	if hasCPU {
+		p.CPU = &statsv1alpha1.CPUStats{Time: ts, UsageCoreNanoSeconds: &coreNanoSeconds}
+		if allNanoCores {
+			p.CPU.UsageNanoCores = &nanoCores
+		}
+	}
+	if hasMemory {
+		p.Memory = &statsv1alpha1.MemoryStats{Time: ts, UsageBytes: &usage, WorkingSetBytes: &workingSet, RSSBytes: &rss}
+	}
+	if hasEphem {
+		p.EphemeralStorage = &statsv1alpha1.FsStats{Time: ts, UsedBytes: &ephem}
+	}
+}
+
+// logsStats 统计容器日志文件(包括历史与轮转的文件)占用的空间
+func logsStats(logDir, containerName string, now time.Time) *statsv1alpha1.FsStats {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return nil
+	}
+	var used, inodes uint64
+	for _, e := range entries {
+		if e.IsDir() || !isContainerLogFile(e.Name(), containerName) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		used += uint64(info.Size())
+		inodes++
+	}
+	fs := fsStats(logDir, now)
+	if fs == nil {
+		fs = &statsv1alpha1.FsStats{Time: metav1.NewTime(now)}
+	}
+	fs.UsedBytes = &used
+	fs.InodesUsed = &inodes
+	return fs
+}
+
+// isContainerLogFile 判断文件是否为容器的日志文件：<name>-<attempt>.log，轮转后的文件带有数字后缀
+func isContainerLogFile(fileName, containerName string) bool {
+	if !strings.HasPrefix(fileName, containerName+"-") {
+		return false
+	}
+	rest := strings.TrimPrefix(fileName, containerName+"-")
+	idx := strings.Index(rest, ".log")
+	if idx <= 0 {
+		return false
+	}
+	_, err := strconv.ParseUint(rest[:idx], 10, 32)
+	return err == nil
+}
+
+// fsStats path所在文件系统的容量信息
+func fsStats(path string, now time.Time) *statsv1alpha1.FsStats {
+	info, err := helper.GetFsInfo(path)
+	if err != nil {
+		klog.Warningf("get fs info of %s err: %s", path, err)
+		return nil
+	}
+	return &statsv1alpha1.FsStats{
+		Time:           metav1.NewTime(now),
+		CapacityBytes:  &info.CapacityBytes,
+		AvailableBytes: &info.AvailableBytes,
+		Inodes:         &info.Inodes,
+		InodesFree:     &info.InodesFree,
+	}
+}
+
+func criUint64(v *criapi.UInt64Value) *uint64 {
+	if v == nil {
+		return nil
+	}
+	value := v.Value
+	return &value
+}
+
+func valueOf(v *uint64) uint64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
@@ -0,0 +1,453 @@
+package providers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/helper"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// emptyDirPerms emptyDir需要所有用户可写
+	emptyDirPerms = 0777
+	// volumeDirPerms configMap、secret等volume的目录权限
+	volumeDirPerms = 0755
+	// volumesDirName pod目录下存放volume的目录
+	volumesDirName = "volumes"
+
+	// 设置fsGroup时加入的组权限，与kubelet一致
+	volumeReadWriteMask = os.FileMode(0660)
+	volumeReadOnlyMask  = os.FileMode(0440)
+	volumeExecMask      = os.FileMode(0110)
+)
+
+// volumeMountError pod中有无法挂载的volume，容器以ContainerCreating等待，不回滚pod
+type volumeMountError struct {
+	message string
+}
+
+func (e *volumeMountError) Error() string {
+	return e.message
+}
+
+// volumeFile volume中需要写入的文件
+type volumeFile struct {
+	data []byte
+	mode int32
+}
+
+// podVolumeDir 返回pod中volume在宿主机上的目录，与pod目录下的etc-hosts等文件区分开
+func (c *CriProvider) podVolumeDir(uid types.UID, volumeName string) string {
+	return filepath.Join(c.podVolRoot, string(uid), volumesDirName, volumeName)
+}
+
+// mountPodVolumes 在podVolRoot/<uid>/volumes/下准备pod的所有volume，
+// 返回volume名称与宿主机路径的对应关系，可重复调用
+func (c *CriProvider) mountPodVolumes(pod *v1.Pod) (map[string]string, error) {
+	c.volumeLock.Lock()
+	defer c.volumeLock.Unlock()
+	volumes := make(map[string]string, len(pod.Spec.Volumes))
+	for i := range pod.Spec.Volumes {
+		vol := &pod.Spec.Volumes[i]
+		// 不支持的volume由unsupportedVolumeError报告，容器不会创建
+		if !isSupportedVolume(vol) {
+			continue
+		}
+		path, err := c.mountVolume(pod, vol)
+		if err != nil {
+			return nil, fmt.Errorf("mount volume %s failed: %v", vol.Name, err)
+		}
+		volumes[vol.Name] = path
+	}
+	return volumes, nil
+}
+
+// mountVolume 准备单个volume，返回宿主机路径
+func (c *CriProvider) mountVolume(pod *v1.Pod, vol *v1.Volume) (string, error) {
+	dir := c.podVolumeDir(pod.UID, vol.Name)
+	fsGroup, policy := podFSGroup(pod)
+	switch {
+	case vol.HostPath != nil:
+		// 与kubelet相同，fsGroup不修改宿主机路径的属组
+		return vol.HostPath.Path, checkHostPath(vol.HostPath)
+	case vol.EmptyDir != nil:
+		if err := mountEmptyDir(dir, vol.EmptyDir); err != nil {
+			return "", err
+		}
+		return dir, setVolumeOwnership(dir, fsGroup, policy, false)
+	}
+
+	payload, err := c.volumePayload(pod, vol)
+	if err != nil {
+		return "", err
+	}
+	// 文件权限中加入组的只读权限，内容没有变化时writeVolumeFiles仍然可以跳过更新
+	if fsGroup != nil {
+		for path, file := range payload {
+			file.mode |= int32(volumeReadOnlyMask)
+			payload[path] = file
+		}
+	}
+	if err = writeVolumeFiles(dir, payload); err != nil {
+		return "", err
+	}
+	// 与kubelet相同，每次写入都会生成新的数据目录，不使用fsGroupChangePolicy跳过
+	return dir, setVolumeOwnership(dir, fsGroup, nil, true)
+}
+
+// podFSGroup 返回pod的fsGroup与fsGroupChangePolicy
+func podFSGroup(pod *v1.Pod) (*int64, *v1.PodFSGroupChangePolicy) {
+	psc := pod.Spec.SecurityContext
+	if psc == nil {
+		return nil, nil
+	}
+	return psc.FSGroup, psc.FSGroupChangePolicy
+}
+
+// setVolumeOwnership 与kubelet相同，把volume中文件的属组改为fsGroup并加入组的读写(readOnly时为只读)权限，
+// 目录设置setgid使新文件继承属组，容器中以fsGroup为附加组的非root用户可以访问volume。
+// fsGroupChangePolicy为OnRootMismatch且volume根目录已经符合要求时不再递归修改
+func setVolumeOwnership(dir string, fsGroup *int64, policy *v1.PodFSGroupChangePolicy, readOnly bool) error {
+	if fsGroup == nil {
+		return nil
+	}
+	mask := volumeReadWriteMask
+	if readOnly {
+		mask = volumeReadOnlyMask
+	}
+	if policy != nil && *policy == v1.FSGroupChangeOnRootMismatch {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int64(st.Gid) == *fsGroup &&
+			info.Mode()&(mask|os.ModeSetgid) == mask|os.ModeSetgid {
+			return nil
+		}
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = os.Lchown(path, -1, int(*fsGroup)); err != nil {
+			return err
+		}
+		// 符号链接的权限没有意义
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := mask
+		if info.IsDir() {
+			mode |= os.ModeSetgid | volumeExecMask
+		}
+		return os.Chmod(path, info.Mode()|mode)
+	})
+}
+
+// isSupportedVolume 是否支持该类型的volume
+func isSupportedVolume(vol *v1.Volume) bool {
+	return vol.HostPath != nil || vol.EmptyDir != nil || vol.ConfigMap != nil || vol.Secret != nil ||
+		vol.DownwardAPI != nil || vol.Projected != nil
+}
+
+// unsupportedVolumeError pod中有不支持的volume(如persistentVolumeClaim)时返回volumeMountError
+func unsupportedVolumeError(pod *v1.Pod) error {
+	var names []string
+	for i := range pod.Spec.Volumes {
+		if !isSupportedVolume(&pod.Spec.Volumes[i]) {
+			names = append(names, pod.Spec.Volumes[i].Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return &volumeMountError{message: fmt.Sprintf("Unable to mount volumes for pod: unmounted volumes=[%s]: unsupported volume type",
+		strings.Join(names, " "))}
+}
+
+// serviceAccountTokenPaths 返回projected volume中serviceAccountToken的路径，这些文件不会生成
+func serviceAccountTokenPaths(pod *v1.Pod) []string {
+	var paths []string
+	for _, vol := range pod.Spec.Volumes {
+		if vol.Projected == nil {
+			continue
+		}
+		for _, source := range vol.Projected.Sources {
+			if source.ServiceAccountToken != nil {
+				paths = append(paths, vol.Name+"/"+source.ServiceAccountToken.Path)
+			}
+		}
+	}
+	return paths
+}
+
+// volumePayload 生成configMap、secret、downwardAPI与projected volume中的文件
+func (c *CriProvider) volumePayload(pod *v1.Pod, vol *v1.Volume) (map[string]volumeFile, error) {
+	switch {
+	case vol.ConfigMap != nil:
+		return c.configMapPayload(pod, &vol.ConfigMap.LocalObjectReference, vol.ConfigMap.Items,
+			modeOrDefault(vol.ConfigMap.DefaultMode, v1.ConfigMapVolumeSourceDefaultMode), vol.ConfigMap.Optional)
+	case vol.Secret != nil:
+		return c.secretPayload(pod, &v1.LocalObjectReference{Name: vol.Secret.SecretName}, vol.Secret.Items,
+			modeOrDefault(vol.Secret.DefaultMode, v1.SecretVolumeSourceDefaultMode), vol.Secret.Optional)
+	case vol.DownwardAPI != nil:
+		return c.downwardAPIPayload(pod, vol.DownwardAPI.Items,
+			modeOrDefault(vol.DownwardAPI.DefaultMode, v1.DownwardAPIVolumeSourceDefaultMode))
+	case vol.Projected != nil:
+		return c.projectedPayload(pod, vol.Projected)
+	}
+	return nil, errdefs.InvalidInputf("volume %s: unsupported volume type", vol.Name)
+}
+
+// configMapPayload 生成configMap中的文件
+func (c *CriProvider) configMapPayload(pod *v1.Pod, ref *v1.LocalObjectReference, items []v1.KeyToPath, defaultMode int32, optional *bool) (map[string]volumeFile, error) {
+	configMap, err := c.getConfigMap(ref.Name, pod.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) && optional != nil && *optional {
+			return map[string]volumeFile{}, nil
+		}
+		return nil, err
+	}
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for k, v := range configMap.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range configMap.BinaryData {
+		data[k] = v
+	}
+	return makePayload(items, data, defaultMode, optional != nil && *optional)
+}
+
+// secretPayload 生成secret中的文件
+func (c *CriProvider) secretPayload(pod *v1.Pod, ref *v1.LocalObjectReference, items []v1.KeyToPath, defaultMode int32, optional *bool) (map[string]volumeFile, error) {
+	secret, err := c.getSecret(ref.Name, pod.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) && optional != nil && *optional {
+			return map[string]volumeFile{}, nil
+		}
+		return nil, err
+	}
+	return makePayload(items, secret.Data, defaultMode, optional != nil && *optional)
+}
+
+// downwardAPIPayload 生成downwardAPI中的文件
+func (c *CriProvider) downwardAPIPayload(pod *v1.Pod, items []v1.DownwardAPIVolumeFile, defaultMode int32) (map[string]volumeFile, error) {
+	payload := make(map[string]volumeFile, len(items))
+	for _, item := range items {
+		if err := validateVolumeFilePath(item.Path); err != nil {
+			return nil, err
+		}
+		var (
+			value string
+			err   error
+		)
+		switch {
+		case item.FieldRef != nil:
+			value, err = extractFieldPathAsString(pod, item.FieldRef.FieldPath)
+		case item.ResourceFieldRef != nil:
+			if item.ResourceFieldRef.ContainerName == "" {
+				return nil, fmt.Errorf("containerName is required for resourceFieldRef %s", item.Path)
+			}
+			value, err = containerResourceRuntimeValue(item.ResourceFieldRef, pod, nil, c.nodeCapacity())
+		}
+		if err != nil {
+			return nil, err
+		}
+		payload[item.Path] = volumeFile{data: []byte(value), mode: modeOrDefault(item.Mode, defaultMode)}
+	}
+	return payload, nil
+}
+
+// projectedPayload 合并projected volume中各个来源的文件
+func (c *CriProvider) projectedPayload(pod *v1.Pod, projected *v1.ProjectedVolumeSource) (map[string]volumeFile, error) {
+	defaultMode := modeOrDefault(projected.DefaultMode, v1.ProjectedVolumeSourceDefaultMode)
+	payload := make(map[string]volumeFile)
+	for _, source := range projected.Sources {
+		var (
+			files map[string]volumeFile
+			err   error
+		)
+		switch {
+		case source.ConfigMap != nil:
+			files, err = c.configMapPayload(pod, &source.ConfigMap.LocalObjectReference, source.ConfigMap.Items, defaultMode, source.ConfigMap.Optional)
+		case source.Secret != nil:
+			files, err = c.secretPayload(pod, &source.Secret.LocalObjectReference, source.Secret.Items, defaultMode, source.Secret.Optional)
+		case source.DownwardAPI != nil:
+			files, err = c.downwardAPIPayload(pod, source.DownwardAPI.Items, defaultMode)
+		case source.ServiceAccountToken != nil:
+			// 没有向apiserver申请token的能力，跳过，创建pod时以事件报告
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for path, file := range files {
+			payload[path] = file
+		}
+	}
+	return payload, nil
+}
+
+// makePayload 按照items把data中的key映射为文件，items为空时映射所有key
+func makePayload(items []v1.KeyToPath, data map[string][]byte, defaultMode int32, optional bool) (map[string]volumeFile, error) {
+	payload := make(map[string]volumeFile, len(data))
+	if len(items) == 0 {
+		for k, v := range data {
+			payload[k] = volumeFile{data: v, mode: defaultMode}
+		}
+		return payload, nil
+	}
+	for _, item := range items {
+		if err := validateVolumeFilePath(item.Path); err != nil {
+			return nil, err
+		}
+		v, ok := data[item.Key]
+		if !ok {
+			if optional {
+				continue
+			}
+			return nil, fmt.Errorf("couldn't find key %s", item.Key)
+		}
+		payload[item.Path] = volumeFile{data: v, mode: modeOrDefault(item.Mode, defaultMode)}
+	}
+	return payload, nil
+}
+
+// mountEmptyDir 创建emptyDir，medium为Memory时挂载tmpfs
+func mountEmptyDir(dir string, emptyDir *v1.EmptyDirVolumeSource) error {
+	if err := os.MkdirAll(dir, emptyDirPerms); err != nil {
+		return err
+	}
+	// MkdirAll受umask影响
+	if err := os.Chmod(dir, emptyDirPerms); err != nil {
+		return err
+	}
+	switch emptyDir.Medium {
+	case v1.StorageMediumDefault:
+		return nil
+	case v1.StorageMediumMemory:
+		mounted, err := helper.IsMountPoint(dir)
+		if err != nil || mounted {
+			return err
+		}
+		options := fmt.Sprintf("mode=%o", emptyDirPerms)
+		if emptyDir.SizeLimit != nil && !emptyDir.SizeLimit.IsZero() {
+			options = fmt.Sprintf("%s,size=%d", options, emptyDir.SizeLimit.Value())
+		}
+		return syscall.Mount("tmpfs", dir, "tmpfs", 0, options)
+	}
+	return errdefs.InvalidInputf("emptyDir medium %s is not supported", emptyDir.Medium)
+}
+
+// checkHostPath 按照hostPath的type检查宿主机路径，OrCreate类型在不存在时创建
+func checkHostPath(hostPath *v1.HostPathVolumeSource) error {
+	path := hostPath.Path
+	pathType := v1.HostPathUnset
+	if hostPath.Type != nil {
+		pathType = *hostPath.Type
+	}
+
+	info, err := os.Stat(path)
+	switch pathType {
+	case v1.HostPathUnset:
+		return nil
+	case v1.HostPathDirectoryOrCreate:
+		if os.IsNotExist(err) {
+			return os.MkdirAll(path, volumeDirPerms)
+		}
+	case v1.HostPathFileOrCreate:
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(filepath.Dir(path), volumeDirPerms); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode()
+	var ok bool
+	switch pathType {
+	case v1.HostPathDirectoryOrCreate, v1.HostPathDirectory:
+		ok = mode.IsDir()
+	case v1.HostPathFileOrCreate, v1.HostPathFile:
+		ok = mode.IsRegular()
+	case v1.HostPathSocket:
+		ok = mode&os.ModeSocket != 0
+	case v1.HostPathCharDev:
+		ok = mode&os.ModeCharDevice != 0
+	case v1.HostPathBlockDev:
+		ok = mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+	default:
+		return errdefs.InvalidInputf("hostPath type %s is not supported", pathType)
+	}
+	if !ok {
+		return errdefs.InvalidInputf("hostPath %s is not a %s", path, pathType)
+	}
+	return nil
+}
+
+// unmountPodVolumes 卸载pod目录下的tmpfs等挂载点，删除pod目录前调用
+func (c *CriProvider) unmountPodVolumes(uid types.UID) error {
+	mounts, err := helper.MountPointsUnder(filepath.Join(c.podVolRoot, string(uid)))
+	if err != nil {
+		return err
+	}
+	for _, mp := range mounts {
+		if err = syscall.Unmount(mp, 0); err != nil {
+			return fmt.Errorf("unmount %s failed: %v", mp, err)
+		}
+	}
+	return nil
+}
+
+// expandVolumeMounts 使用容器的环境变量展开subPathExpr
+func expandVolumeMounts(container *v1.Container, envs []v1.EnvVar) {
+	env := make(map[string]string, len(envs))
+	for _, e := range envs {
+		env[e.Name] = e.Value
+	}
+	// 复制一份，避免修改pod中的配置
+	mounts := make([]v1.VolumeMount, len(container.VolumeMounts))
+	copy(mounts, container.VolumeMounts)
+	for i := range mounts {
+		if mounts[i].SubPathExpr != "" {
+			mounts[i].SubPath = expandEnv(mounts[i].SubPathExpr, env)
+		}
+	}
+	container.VolumeMounts = mounts
+}
+
+// validateVolumeFilePath 文件路径必须为相对路径，并且不能包含..
+func validateVolumeFilePath(path string) error {
+	if path == "" || filepath.IsAbs(path) {
+		return fmt.Errorf("invalid path %q: must be a relative path", path)
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return fmt.Errorf("invalid path %q: must not contain '..'", path)
+		}
+	}
+	return nil
+}
+
+// modeOrDefault 文件权限，没有设置时使用默认值
+func modeOrDefault(mode *int32, defaultMode int32) int32 {
+	if mode != nil {
+		return *mode
+	}
+	return defaultMode
+}
@@ -0,0 +1,142 @@
+package providers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestMakePayload(t *testing.T) {
+	mode := int32(0600)
+	data := map[string][]byte{"a": []byte("A"), "b": []byte("B")}
+	tests := []struct {
+		name     string
+		items    []v1.KeyToPath
+		optional bool
+		want     map[string]volumeFile
+		wantErr  bool
+	}{
+		{
+			name: "all keys",
+			want: map[string]volumeFile{
+				"a": {data: []byte("A"), mode: 0644},
+				"b": {data: []byte("B"), mode: 0644},
+			},
+		},
+		{
+			name:  "selected items",
+			items: []v1.KeyToPath{{Key: "a", Path: "dir/a.txt"}, {Key: "b", Path: "b", Mode: &mode}},
+			want: map[string]volumeFile{
+				"dir/a.txt": {data: []byte("A"), mode: 0644},
+				"b":         {data: []byte("B"), mode: 0600},
+			},
+		},
+		{
+			name:    "missing key",
+			items:   []v1.KeyToPath{{Key: "c", Path: "c"}},
+			wantErr: true,
+		},
+		{
+			name:     "missing optional key",
+			items:    []v1.KeyToPath{{Key: "a", Path: "a"}, {Key: "c", Path: "c"}},
+			optional: true,
+			want:     map[string]volumeFile{"a": {data: []byte("A"), mode: 0644}},
+		},
+		{
+			name:    "absolute path",
+			items:   []v1.KeyToPath{{Key: "a", Path: "/etc/a"}},
+			wantErr: true,
+		},
+		{
+			name:    "parent path",
+			items:   []v1.KeyToPath{{Key: "a", Path: "../a"}},
+			wantErr: true,
+		},
+		{
+			name:  "dots in name",
+			items: []v1.KeyToPath{{Key: "a", Path: "a..b"}},
+			want:  map[string]volumeFile{"a..b": {data: []byte("A"), mode: 0644}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makePayload(tt.items, data, 0644, tt.optional)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("makePayload() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("makePayload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnsupportedVolumeError(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Volumes: []v1.Volume{
+		{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+		{Name: "nfs", VolumeSource: v1.VolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs", Path: "/"}}},
+	}}}
+	err := unsupportedVolumeError(pod)
+	if _, ok := err.(*volumeMountError); !ok {
+		t.Fatalf("unsupportedVolumeError() = %v, want volumeMountError", err)
+	}
+	want := "Unable to mount volumes for pod: unmounted volumes=[data nfs]: unsupported volume type"
+	if err.Error() != want {
+		t.Errorf("unsupportedVolumeError() = %q, want %q", err.Error(), want)
+	}
+	if waiting := containerWaitingForError(err); waiting.Reason != reasonContainerCreating || waiting.Message != want {
+		t.Errorf("containerWaitingForError() = %+v", waiting)
+	}
+
+	pod.Spec.Volumes = pod.Spec.Volumes[:1]
+	if err = unsupportedVolumeError(pod); err != nil {
+		t.Errorf("unsupportedVolumeError() = %v, want nil", err)
+	}
+}
+
+func TestSetVolumeOwnership(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// 只能把属组修改为当前进程所在的组
+	gid := int64(os.Getgid())
+	if err := setVolumeOwnership(dir, &gid, nil, false); err != nil {
+		t.Fatalf("setVolumeOwnership() err = %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want os.FileMode
+	}{
+		{path: "sub", want: os.ModeDir | os.ModeSetgid | 0775},
+		{path: "sub/file", want: 0660},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(filepath.Join(dir, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != tt.want {
+			t.Errorf("mode of %s = %v, want %v", tt.path, info.Mode(), tt.want)
+		}
+		if st := info.Sys().(*syscall.Stat_t); int64(st.Gid) != gid {
+			t.Errorf("gid of %s = %d, want %d", tt.path, st.Gid, gid)
+		}
+	}
+
+	if err := setVolumeOwnership(dir, nil, nil, false); err != nil {
+		t.Errorf("setVolumeOwnership() without fsGroup err = %v", err)
+	}
+}
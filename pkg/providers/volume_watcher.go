@@ -0,0 +1,292 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// volumeResyncPeriod informer的全量同步周期，防止漏掉事件
+const volumeResyncPeriod = time.Minute
+
+// volumeObject volume引用的configMap或secret
+type volumeObject struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// objectWatch 单个对象的informer，引用它的pod都删除后停止
+type objectWatch struct {
+	store      cache.Store
+	controller cache.Controller
+	stop       chan struct{}
+	// refs 引用该对象的pod数量
+	refs int
+}
+
+// volumeWatcher 与kubelet的watch-based manager类似，只监听本节点pod的volume引用的configMap与secret，
+// 每个对象使用按名称过滤的informer，不缓存集群中其它对象，也不需要集群范围的list权限
+type volumeWatcher struct {
+	client   kubernetes.Interface
+	onChange func(kind, namespace, name string)
+
+	mu sync.Mutex
+	// ctx start之后有效，informer随之停止
+	ctx     context.Context
+	watches map[volumeObject]*objectWatch
+	// pods pod引用的对象，用于删除pod时释放
+	pods map[types.UID][]volumeObject
+}
+
+// newVolumeWatcher 创建监听器，onChange的参数为变化对象的类型、namespace与名称
+func newVolumeWatcher(client kubernetes.Interface, onChange func(kind, namespace, name string)) *volumeWatcher {
+	return &volumeWatcher{
+		client:   client,
+		onChange: onChange,
+		watches:  map[volumeObject]*objectWatch{},
+		pods:     map[types.UID][]volumeObject{},
+	}
+}
+
+// start 启动已经添加的informer，之后添加的informer立即启动，ctx结束时全部停止
+func (w *volumeWatcher) start(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ctx = ctx
+	for _, ow := range w.watches {
+		w.run(ow)
+	}
+}
+
+// run 运行informer，调用时需要持有w.mu
+func (w *volumeWatcher) run(ow *objectWatch) {
+	ctx := w.ctx
+	stop := make(chan struct{})
+	go func() {
+		defer close(stop)
+		select {
+		case <-ctx.Done():
+		case <-ow.stop:
+		}
+	}()
+	go ow.controller.Run(stop)
+}
+
+// addPod 监听pod的volume引用的对象，重复添加时以最新的pod为准
+func (w *volumeWatcher) addPod(pod *v1.Pod) {
+	objects := podVolumeObjects(pod)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, obj := range objects {
+		ow, ok := w.watches[obj]
+		if !ok {
+			ow = w.newObjectWatch(obj)
+			w.watches[obj] = ow
+			if w.ctx != nil {
+				w.run(ow)
+			}
+		}
+		ow.refs++
+	}
+	w.release(w.pods[pod.UID])
+	w.pods[pod.UID] = objects
+}
+
+// removePod 释放pod引用的对象，没有pod引用时停止监听
+func (w *volumeWatcher) removePod(uid types.UID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.release(w.pods[uid])
+	delete(w.pods, uid)
+}
+
+// release 减少对象的引用计数，调用时需要持有w.mu
+func (w *volumeWatcher) release(objects []volumeObject) {
+	for _, obj := range objects {
+		ow, ok := w.watches[obj]
+		if !ok {
+			continue
+		}
+		ow.refs--
+		if ow.refs <= 0 {
+			close(ow.stop)
+			delete(w.watches, obj)
+		}
+	}
+}
+
+// get 从缓存中获取对象，对象没有被监听或缓存还未同步时ok为false；
+// 同步后对象不存在时返回nil
+func (w *volumeWatcher) get(kind, namespace, name string) (runtime.Object, bool) {
+	w.mu.Lock()
+	ow, ok := w.watches[volumeObject{kind: kind, namespace: namespace, name: name}]
+	w.mu.Unlock()
+	if !ok || !ow.controller.HasSynced() {
+		return nil, false
+	}
+	item, exists, err := ow.store.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil, true
+	}
+	return item.(runtime.Object), true
+}
+
+// newObjectWatch 创建按名称过滤的informer
+func (w *volumeWatcher) newObjectWatch(obj volumeObject) *objectWatch {
+	selector := fields.OneTermEqualSelector("metadata.name", obj.name).String()
+	var lw *cache.ListWatch
+	var objType runtime.Object
+	switch obj.kind {
+	case "ConfigMap":
+		configMaps := w.client.CoreV1().ConfigMaps(obj.namespace)
+		objType = &v1.ConfigMap{}
+		lw = &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return configMaps.List(context.Background(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return configMaps.Watch(context.Background(), options)
+			},
+		}
+	default:
+		secrets := w.client.CoreV1().Secrets(obj.namespace)
+		objType = &v1.Secret{}
+		lw = &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return secrets.List(context.Background(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return secrets.Watch(context.Background(), options)
+			},
+		}
+	}
+	store, controller := cache.NewInformer(lw, objType, volumeResyncPeriod, volumeEventHandler(obj.kind, w.onChange))
+	return &objectWatch{store: store, controller: controller, stop: make(chan struct{})}
+}
+
+// podVolumeObjects pod的volume引用的configMap与secret，去掉重复的引用
+func podVolumeObjects(pod *v1.Pod) []volumeObject {
+	var objects []volumeObject
+	seen := map[volumeObject]bool{}
+	add := func(kind, name string) {
+		obj := volumeObject{kind: kind, namespace: pod.Namespace, name: name}
+		if name == "" || seen[obj] {
+			return
+		}
+		seen[obj] = true
+		objects = append(objects, obj)
+	}
+	for _, vol := range pod.Spec.Volumes {
+		switch {
+		case vol.ConfigMap != nil:
+			add("ConfigMap", vol.ConfigMap.Name)
+		case vol.Secret != nil:
+			add("Secret", vol.Secret.SecretName)
+		case vol.Projected != nil:
+			for _, source := range vol.Projected.Sources {
+				if source.ConfigMap != nil {
+					add("ConfigMap", source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					add("Secret", source.Secret.Name)
+				}
+			}
+		}
+	}
+	return objects
+}
+
+// watchPodVolumes 监听pod的volume引用的configMap与secret
+func (c *CriProvider) watchPodVolumes(pod *v1.Pod) {
+	if c.volumeWatcher != nil {
+		c.volumeWatcher.addPod(pod)
+	}
+}
+
+// unwatchPodVolumes 停止监听pod引用的对象
+func (c *CriProvider) unwatchPodVolumes(uid types.UID) {
+	if c.volumeWatcher != nil {
+		c.volumeWatcher.removePod(uid)
+	}
+}
+
+// volumeEventHandler 把informer事件转换为对象的namespace与名称
+func volumeEventHandler(kind string, onChange func(kind, namespace, name string)) cache.ResourceEventHandler {
+	handle := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			klog.Errorf("get %s key err: %s", kind, err)
+			return
+		}
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			klog.Errorf("split %s key err: %s", kind, err)
+			return
+		}
+		onChange(kind, namespace, name)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: handle,
+		UpdateFunc: func(_, newObj interface{}) {
+			handle(newObj)
+		},
+		DeleteFunc: handle,
+	}
+}
+
+// syncVolumesFor configMap或secret变化后，重新写入引用它的volume
+func (c *CriProvider) syncVolumesFor(kind, namespace, name string) {
+	for _, pod := range c.PodManager.listPods() {
+		if pod.Namespace != namespace {
+			continue
+		}
+		for i := range pod.Spec.Volumes {
+			vol := &pod.Spec.Volumes[i]
+			if !volumeReferences(vol, kind, name) {
+				continue
+			}
+			// 内容没有变化时writeVolumeFiles不会重写文件
+			c.volumeLock.Lock()
+			_, err := c.mountVolume(pod, vol)
+			c.volumeLock.Unlock()
+			if err != nil {
+				klog.Errorf("sync volume %s of pod %s/%s err: %s", vol.Name, pod.Namespace, pod.Name, err)
+			}
+		}
+	}
+}
+
+// volumeReferences volume是否引用了指定的configMap或secret
+func volumeReferences(vol *v1.Volume, kind, name string) bool {
+	switch {
+	case vol.ConfigMap != nil:
+		return kind == "ConfigMap" && vol.ConfigMap.Name == name
+	case vol.Secret != nil:
+		return kind == "Secret" && vol.Secret.SecretName == name
+	case vol.Projected != nil:
+		for _, source := range vol.Projected.Sources {
+			if source.ConfigMap != nil && kind == "ConfigMap" && source.ConfigMap.Name == name {
+				return true
+			}
+			if source.Secret != nil && kind == "Secret" && source.Secret.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
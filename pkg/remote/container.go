@@ -3,6 +3,10 @@ package remote
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	v1 "k8s.io/api/core/v1"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
@@ -47,6 +51,35 @@ func StartContainer(ctx context.Context, client criapi.RuntimeServiceClient, cId
 	return nil
 }
 
+// StopContainer 停止容器，timeout秒后强制杀死容器进程
+func StopContainer(ctx context.Context, client criapi.RuntimeServiceClient, cId string, timeout int64) error {
+
+	if cId == "" {
+		return errdefs.InvalidInput("ID cannot be empty")
+	}
+	request := &criapi.StopContainerRequest{
+		ContainerId: cId,
+		Timeout:     timeout,
+	}
+
+	_, err := client.StopContainer(ctx, request)
+	return err
+}
+
+// RemoveContainer 删除容器，容器正在运行时会被强制停止
+func RemoveContainer(ctx context.Context, client criapi.RuntimeServiceClient, cId string) error {
+
+	if cId == "" {
+		return errdefs.InvalidInput("ID cannot be empty")
+	}
+	request := &criapi.RemoveContainerRequest{
+		ContainerId: cId,
+	}
+
+	_, err := client.RemoveContainer(ctx, request)
+	return err
+}
+
 // GetContainerCRIStatus 获取容器状态
 func GetContainerCRIStatus(ctx context.Context, client criapi.RuntimeServiceClient, cId string) (*criapi.ContainerStatus, error) {
 
@@ -89,7 +122,9 @@ func GetContainersForSandbox(ctx context.Context, client criapi.RuntimeServiceCl
 }
 
 // GenerateContainerConfig 由node提供的pod配置，生成CRI需要的容器配置文件
-func GenerateContainerConfig(_ context.Context, container *v1.Container, pod *v1.Pod, imageRef, podVolRoot string, attempt uint32) (*criapi.ContainerConfig, error) {
+// volumes 为volume名称与宿主机路径的对应关系，etcHostsPath为pod的hosts文件，
+// memoryCapacity为节点的内存容量，用于计算oom_score_adj
+func GenerateContainerConfig(_ context.Context, container *v1.Container, pod *v1.Pod, imageRef string, volumes map[string]string, etcHostsPath string, attempt uint32, memoryCapacity int64) (*criapi.ContainerConfig, error) {
 
 	// FIXME: 有些容器特行目前没有支持
 	config := &criapi.ContainerConfig{
@@ -97,23 +132,244 @@ func GenerateContainerConfig(_ context.Context, container *v1.Container, pod *v1
 			Name:    container.Name,
 			Attempt: attempt,
 		},
-		Image:      &criapi.ImageSpec{Image: imageRef},
-		Command:    container.Command,
-		Args:       container.Args,
-		WorkingDir: container.WorkingDir,
-		//Envs:        createCtrEnvVars(container.Env),
-		//Labels:      createCtrLabels(container, pod),
-		//Annotations: createCtrAnnotations(container, pod),
-		//Linux:       createCtrLinuxConfig(container, pod),
-		LogPath:   fmt.Sprintf("%s-%d.log", container.Name, attempt),
-		Stdin:     container.Stdin,
-		StdinOnce: container.StdinOnce,
-		Tty:       container.TTY,
-	}
-	//mounts, err := createCtrMounts(ctx, container, pod, podVolRoot, rm)
-	//if err != nil {
-	// return nil, err
-	//}
-	//config.Mounts = mounts
+		Image:       &criapi.ImageSpec{Image: imageRef},
+		Command:     container.Command,
+		Args:        container.Args,
+		WorkingDir:  container.WorkingDir,
+		Envs:        createCtrEnvVars(container.Env),
+		Labels:      createCtrLabels(container, pod),
+		Annotations: createCtrAnnotations(container, pod, attempt),
+		LogPath:     ContainerLogFileName(container.Name, attempt),
+		Stdin:       container.Stdin,
+		StdinOnce:   container.StdinOnce,
+		Tty:         container.TTY,
+	}
+	linux, err := createCtrLinuxConfig(container, pod, memoryCapacity)
+	if err != nil {
+		return nil, err
+	}
+	config.Linux = linux
+	mounts, err := createCtrMounts(container, volumes, etcHostsPath)
+	if err != nil {
+		return nil, err
+	}
+	config.Mounts = mounts
 	return config, nil
 }
+
+// ContainerLogFileName 容器日志文件名，相对于pod sandbox的LogDirectory
+func ContainerLogFileName(containerName string, attempt uint32) string {
+	return fmt.Sprintf("%s-%d.log", containerName, attempt)
+}
+
+// ExecSync 在容器中同步执行命令，返回标准输出、标准错误与退出码
+func ExecSync(ctx context.Context, client criapi.RuntimeServiceClient, cId string, cmd []string, timeout int64) (*criapi.ExecSyncResponse, error) {
+
+	if cId == "" {
+		err := errdefs.InvalidInput("ID cannot be empty")
+		return nil, err
+	}
+	request := &criapi.ExecSyncRequest{
+		ContainerId: cId,
+		Cmd:         cmd,
+		Timeout:     timeout,
+	}
+
+	r, err := client.ExecSync(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Exec 准备在容器中执行命令的流式请求，返回streaming server的url
+func Exec(ctx context.Context, client criapi.RuntimeServiceClient, request *criapi.ExecRequest) (string, error) {
+
+	if request.ContainerId == "" {
+		err := errdefs.InvalidInput("ID cannot be empty")
+		return "", err
+	}
+
+	r, err := client.Exec(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return r.Url, nil
+}
+
+// Attach 准备attach到容器的流式请求，返回streaming server的url
+func Attach(ctx context.Context, client criapi.RuntimeServiceClient, request *criapi.AttachRequest) (string, error) {
+
+	if request.ContainerId == "" {
+		err := errdefs.InvalidInput("ID cannot be empty")
+		return "", err
+	}
+
+	r, err := client.Attach(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return r.Url, nil
+}
+
+// ListContainerStats 获取容器的资源使用情况
+func ListContainerStats(ctx context.Context, client criapi.RuntimeServiceClient, filter *criapi.ContainerStatsFilter) ([]*criapi.ContainerStats, error) {
+
+	request := &criapi.ListContainerStatsRequest{
+		Filter: filter,
+	}
+
+	r, err := client.ListContainerStats(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return r.Stats, nil
+}
+
+// GetContainerStats 获取单个容器的资源使用情况
+func GetContainerStats(ctx context.Context, client criapi.RuntimeServiceClient, cId string) (*criapi.ContainerStats, error) {
+
+	if cId == "" {
+		err := errdefs.InvalidInput("ID cannot be empty")
+		return nil, err
+	}
+	request := &criapi.ContainerStatsRequest{
+		ContainerId: cId,
+	}
+
+	r, err := client.ContainerStats(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return r.Stats, nil
+}
+
+// createCtrEnvVars 生成CRI需要的环境变量，valueFrom需要调用方提前解析为Value
+func createCtrEnvVars(in []v1.EnvVar) []*criapi.KeyValue {
+	out := make([]*criapi.KeyValue, 0, len(in))
+	for _, env := range in {
+		if env.ValueFrom != nil && env.Value == "" {
+			continue
+		}
+		out = append(out, &criapi.KeyValue{
+			Key:   env.Name,
+			Value: env.Value,
+		})
+	}
+	return out
+}
+
+// etcHostsMountPath hosts文件在容器中的路径
+const etcHostsMountPath = "/etc/hosts"
+
+// createCtrMounts 由volumeMounts生成CRI需要的挂载配置，容器没有自己挂载/etc/hosts时挂载etcHostsPath
+func createCtrMounts(container *v1.Container, volumes map[string]string, etcHostsPath string) ([]*criapi.Mount, error) {
+	mounts := make([]*criapi.Mount, 0, len(container.VolumeMounts)+1)
+	mountEtcHosts := etcHostsPath != ""
+	for _, mount := range container.VolumeMounts {
+		if mount.MountPath == etcHostsMountPath {
+			mountEtcHosts = false
+		}
+		hostPath, ok := volumes[mount.Name]
+		if !ok {
+			return nil, errdefs.InvalidInputf("volume %s of container %s could not be found", mount.Name, container.Name)
+		}
+		if mount.SubPath != "" {
+			var err error
+			hostPath, err = resolveSubPath(hostPath, mount.Name, mount.SubPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		mounts = append(mounts, &criapi.Mount{
+			ContainerPath: mount.MountPath,
+			HostPath:      hostPath,
+			Readonly:      mount.ReadOnly,
+			Propagation:   createCtrMountPropagation(mount.MountPropagation),
+		})
+	}
+	if mountEtcHosts {
+		mounts = append(mounts, &criapi.Mount{
+			ContainerPath: etcHostsMountPath,
+			HostPath:      etcHostsPath,
+		})
+	}
+	return mounts, nil
+}
+
+// resolveSubPath 解析volume中的subPath，返回宿主机上的路径。
+// subPath中不能有".."，逐级解析符号链接后必须仍然位于volume目录下；与kubelet一致，不存在的目录逐级创建
+func resolveSubPath(volumePath, volumeName, subPath string) (string, error) {
+	if filepath.IsAbs(subPath) {
+		return "", errdefs.InvalidInputf("invalid subPath %q of volume %s: must be a relative path", subPath, volumeName)
+	}
+	elems := strings.Split(filepath.ToSlash(subPath), "/")
+	for _, elem := range elems {
+		if elem == ".." {
+			return "", errdefs.InvalidInputf("invalid subPath %q of volume %s: must not contain '..'", subPath, volumeName)
+		}
+	}
+	root, err := filepath.EvalSymlinks(volumePath)
+	if err != nil {
+		return "", err
+	}
+	current := root
+	for _, elem := range elems {
+		if elem == "" || elem == "." {
+			continue
+		}
+		next := filepath.Join(current, elem)
+		if _, err := os.Lstat(next); os.IsNotExist(err) {
+			if err := os.Mkdir(next, 0755); err != nil && !os.IsExist(err) {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+		// 每一级都解析符号链接，避免创建目录时跟随指向volume之外的链接
+		resolved, err := filepath.EvalSymlinks(next)
+		if err != nil {
+			return "", err
+		}
+		if !isSubPath(root, resolved) {
+			return "", errdefs.InvalidInputf("invalid subPath %q of volume %s: resolves outside of the volume", subPath, volumeName)
+		}
+		current = resolved
+	}
+	return current, nil
+}
+
+// isSubPath path是否为root或root下的路径
+func isSubPath(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// createCtrMountPropagation 转换挂载传播方式，默认为private
+func createCtrMountPropagation(mode *v1.MountPropagationMode) criapi.MountPropagation {
+	if mode == nil {
+		return criapi.MountPropagation_PROPAGATION_PRIVATE
+	}
+	switch *mode {
+	case v1.MountPropagationHostToContainer:
+		return criapi.MountPropagation_PROPAGATION_HOST_TO_CONTAINER
+	case v1.MountPropagationBidirectional:
+		return criapi.MountPropagation_PROPAGATION_BIDIRECTIONAL
+	}
+	return criapi.MountPropagation_PROPAGATION_PRIVATE
+}
+
+// createCtrLinuxConfig 生成容器的cgroup资源限制与安全配置
+func createCtrLinuxConfig(container *v1.Container, pod *v1.Pod, memoryCapacity int64) (*criapi.LinuxContainerConfig, error) {
+	sc, err := createCtrSecurityContext(container, pod)
+	if err != nil {
+		return nil, err
+	}
+	return &criapi.LinuxContainerConfig{
+		Resources:       createCtrResources(container, pod, memoryCapacity),
+		SecurityContext: sc,
+	}, nil
+}
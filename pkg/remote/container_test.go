@@ -0,0 +1,61 @@
+package remote
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSubPath(t *testing.T) {
+	volume := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(volume, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(volume, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir", filepath.Join(volume, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../..", filepath.Join(volume, "dir", "up")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := filepath.EvalSymlinks(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		subPath string
+		want    string
+		wantErr bool
+	}{
+		{subPath: "dir", want: filepath.Join(root, "dir")},
+		{subPath: "a..b", want: filepath.Join(root, "a..b")},
+		{subPath: "new/nested", want: filepath.Join(root, "new", "nested")},
+		{subPath: "./dir", want: filepath.Join(root, "dir")},
+		{subPath: "link/inner", want: filepath.Join(root, "dir", "inner")},
+		{subPath: "/etc", wantErr: true},
+		{subPath: "../etc", wantErr: true},
+		{subPath: "dir/../../etc", wantErr: true},
+		{subPath: "escape", wantErr: true},
+		{subPath: "escape/created", wantErr: true},
+		{subPath: "dir/up", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subPath, func(t *testing.T) {
+			got, err := resolveSubPath(volume, "vol", tt.subPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveSubPath() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveSubPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	// 解析失败时不能在volume之外创建目录
+	if _, err := os.Stat(filepath.Join(outside, "created")); !os.IsNotExist(err) {
+		t.Errorf("directory created outside of the volume, err = %v", err)
+	}
+}
@@ -23,3 +23,29 @@ func PullImage(ctx context.Context, client criapi.ImageServiceClient, image stri
 
 	return r.ImageRef, nil
 }
+
+// ImageFsInfo 获取存放镜像的文件系统使用情况
+func ImageFsInfo(ctx context.Context, client criapi.ImageServiceClient) ([]*criapi.FilesystemUsage, error) {
+
+	r, err := client.ImageFsInfo(ctx, &criapi.ImageFsInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return r.ImageFilesystems, nil
+}
+
+// ImageStatus 获取镜像信息，镜像不存在时返回nil
+func ImageStatus(ctx context.Context, client criapi.ImageServiceClient, image string) (*criapi.Image, error) {
+
+	request := &criapi.ImageStatusRequest{
+		Image: &criapi.ImageSpec{
+			Image: image,
+		},
+	}
+
+	r, err := client.ImageStatus(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return r.Image, nil
+}
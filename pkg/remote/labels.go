@@ -0,0 +1,114 @@
+package remote
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// 与kubelet一致的label与annotation，crictl等工具可以识别
+const (
+	PodNameLabel       = "io.kubernetes.pod.name"
+	PodNamespaceLabel  = "io.kubernetes.pod.namespace"
+	PodUIDLabel        = "io.kubernetes.pod.uid"
+	ContainerNameLabel = "io.kubernetes.container.name"
+
+	// NodeNameLabel 创建sandbox的虚拟节点名称，用于区分kubelet等其他工具创建的sandbox
+	NodeNameLabel = "virtual-kubelet.io/node-name"
+	// InitContainerLabel 标记init容器，重启后没有pod配置时也能区分init容器
+	InitContainerLabel = "virtual-kubelet.io/init-container"
+
+	ContainerHashAnnotation                     = "io.kubernetes.container.hash"
+	ContainerRestartCountAnnotation             = "io.kubernetes.container.restartCount"
+	ContainerTerminationMessagePathAnnotation   = "io.kubernetes.container.terminationMessagePath"
+	ContainerTerminationMessagePolicyAnnotation = "io.kubernetes.container.terminationMessagePolicy"
+	ContainerPortsAnnotation                    = "io.kubernetes.container.ports"
+	PodDeletionGracePeriodAnnotation            = "io.kubernetes.pod.deletionGracePeriod"
+	PodTerminationGracePeriodAnnotation         = "io.kubernetes.pod.terminationGracePeriod"
+)
+
+// createPodLabels sandbox的label，pod的label加上pod名称、namespace、uid与所属节点。
+// 这些label在pod的label之后写入，pod不能通过同名label伪造sandbox的归属
+func createPodLabels(pod *v1.Pod, nodeName string) map[string]string {
+	labels := make(map[string]string, len(pod.Labels)+4)
+	for k, v := range pod.Labels {
+		labels[k] = v
+	}
+	labels[PodNameLabel] = pod.Name
+	labels[PodNamespaceLabel] = pod.Namespace
+	labels[PodUIDLabel] = string(pod.UID)
+	labels[NodeNameLabel] = nodeName
+	return labels
+}
+
+// createCtrLabels 容器的label，只包含识别容器所需的信息
+func createCtrLabels(container *v1.Container, pod *v1.Pod) map[string]string {
+	labels := map[string]string{
+		PodNameLabel:       pod.Name,
+		PodNamespaceLabel:  pod.Namespace,
+		PodUIDLabel:        string(pod.UID),
+		ContainerNameLabel: container.Name,
+	}
+	if IsInitContainer(container.Name, pod) {
+		labels[InitContainerLabel] = "true"
+	}
+	return labels
+}
+
+// IsInitContainer 判断容器是否为pod的init容器
+func IsInitContainer(name string, pod *v1.Pod) bool {
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// createCtrAnnotations 容器的annotation，记录容器配置的hash与重启次数等信息
+func createCtrAnnotations(container *v1.Container, pod *v1.Pod, restartCount uint32) map[string]string {
+	annotations := map[string]string{
+		ContainerHashAnnotation:                     strconv.FormatUint(HashContainer(specContainer(container, pod)), 16),
+		ContainerRestartCountAnnotation:             strconv.Itoa(int(restartCount)),
+		ContainerTerminationMessagePathAnnotation:   container.TerminationMessagePath,
+		ContainerTerminationMessagePolicyAnnotation: string(container.TerminationMessagePolicy),
+	}
+	if pod.DeletionGracePeriodSeconds != nil {
+		annotations[PodDeletionGracePeriodAnnotation] = strconv.FormatInt(*pod.DeletionGracePeriodSeconds, 10)
+	}
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		annotations[PodTerminationGracePeriodAnnotation] = strconv.FormatInt(*pod.Spec.TerminationGracePeriodSeconds, 10)
+	}
+	if len(container.Ports) > 0 {
+		ports, err := json.Marshal(container.Ports)
+		if err != nil {
+			klog.Errorf("marshal ports of container %s err: %s", container.Name, err)
+		} else {
+			annotations[ContainerPortsAnnotation] = string(ports)
+		}
+	}
+	return annotations
+}
+
+// specContainer 返回pod中原始的容器配置，container中的环境变量等已经被解析，不能用于计算hash
+func specContainer(container *v1.Container, pod *v1.Pod) *v1.Container {
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			if containers[i].Name == container.Name {
+				return &containers[i]
+			}
+		}
+	}
+	return container
+}
+
+// HashContainer 计算容器配置的hash，配置变化时hash也会变化
+func HashContainer(container *v1.Container) uint64 {
+	hasher := fnv.New32a()
+	b, _ := json.Marshal(container)
+	_, _ = hasher.Write(b)
+	return uint64(hasher.Sum32())
+}
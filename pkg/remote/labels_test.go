@@ -0,0 +1,60 @@
+package remote
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreatePodLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   map[string]string
+	}{
+		{
+			name: "no labels",
+			want: map[string]string{
+				PodNameLabel:      "pod",
+				PodNamespaceLabel: "default",
+				PodUIDLabel:       "uid",
+				NodeNameLabel:     "vk",
+			},
+		},
+		{
+			name:   "user labels",
+			labels: map[string]string{"app": "nginx"},
+			want: map[string]string{
+				"app":             "nginx",
+				PodNameLabel:      "pod",
+				PodNamespaceLabel: "default",
+				PodUIDLabel:       "uid",
+				NodeNameLabel:     "vk",
+			},
+		},
+		{
+			name: "reserved labels cannot be overridden",
+			labels: map[string]string{
+				PodNameLabel:  "other",
+				PodUIDLabel:   "other-uid",
+				NodeNameLabel: "other-node",
+			},
+			want: map[string]string{
+				PodNameLabel:      "pod",
+				PodNamespaceLabel: "default",
+				PodUIDLabel:       "uid",
+				NodeNameLabel:     "vk",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid", Labels: tt.labels}}
+			if got := createPodLabels(pod, "vk"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("createPodLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
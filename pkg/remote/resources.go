@@ -0,0 +1,133 @@
+package remote
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// 与kubelet中的cgroup参数计算方式一致
+const (
+	minShares     = 2
+	sharesPerCPU  = 1024
+	milliCPUToCPU = 1000
+	// quotaPeriod cfs默认周期100ms，单位微秒
+	quotaPeriod = 100000
+	// minQuotaPeriod cfs quota的最小值，单位微秒
+	minQuotaPeriod = 1000
+
+	// oom_score_adj，Guaranteed的pod最不容易被oom kill
+	guaranteedOOMScoreAdj = -997
+	besteffortOOMScoreAdj = 1000
+)
+
+// PodQOSClass 计算pod的QoS类型：
+// 所有容器的cpu与内存都设置了limits并且requests与limits相等时为Guaranteed，
+// 都没有设置requests与limits时为BestEffort，其余为Burstable
+func PodQOSClass(pod *v1.Pod) v1.PodQOSClass {
+	requests := v1.ResourceList{}
+	limits := v1.ResourceList{}
+	isGuaranteed := true
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+				req, hasReq := c.Resources.Requests[name]
+				if hasReq && !req.IsZero() {
+					addQuantity(requests, name, req)
+				}
+				limit, hasLimit := c.Resources.Limits[name]
+				if hasLimit && !limit.IsZero() {
+					addQuantity(limits, name, limit)
+				} else {
+					isGuaranteed = false
+				}
+				if hasReq && hasLimit && req.Cmp(limit) != 0 {
+					isGuaranteed = false
+				}
+			}
+		}
+	}
+	if len(requests) == 0 && len(limits) == 0 {
+		return v1.PodQOSBestEffort
+	}
+	if isGuaranteed {
+		return v1.PodQOSGuaranteed
+	}
+	return v1.PodQOSBurstable
+}
+
+func addQuantity(list v1.ResourceList, name v1.ResourceName, q resource.Quantity) {
+	if v, ok := list[name]; ok {
+		v.Add(q)
+		list[name] = v
+		return
+	}
+	list[name] = q.DeepCopy()
+}
+
+// createCtrResources 由容器的requests与limits生成cgroup配置，memoryCapacity为节点的内存容量
+func createCtrResources(container *v1.Container, pod *v1.Pod, memoryCapacity int64) *criapi.LinuxContainerResources {
+	resources := &criapi.LinuxContainerResources{}
+
+	// cpu shares按照requests计算，没有设置requests时使用limits
+	cpuRequest := container.Resources.Requests.Cpu()
+	cpuLimit := container.Resources.Limits.Cpu()
+	if cpuRequest.IsZero() && !cpuLimit.IsZero() {
+		cpuRequest = cpuLimit
+	}
+	resources.CpuShares = milliCPUToShares(cpuRequest.MilliValue())
+	if !cpuLimit.IsZero() {
+		resources.CpuQuota = milliCPUToQuota(cpuLimit.MilliValue())
+		resources.CpuPeriod = quotaPeriod
+	}
+	if memoryLimit := container.Resources.Limits.Memory(); !memoryLimit.IsZero() {
+		resources.MemoryLimitInBytes = memoryLimit.Value()
+	}
+	resources.OomScoreAdj = containerOOMScoreAdj(container, pod, memoryCapacity)
+	return resources
+}
+
+// milliCPUToShares cpu(milli)转换为cpu shares
+func milliCPUToShares(milliCPU int64) int64 {
+	if milliCPU == 0 {
+		return minShares
+	}
+	shares := milliCPU * sharesPerCPU / milliCPUToCPU
+	if shares < minShares {
+		return minShares
+	}
+	return shares
+}
+
+// milliCPUToQuota cpu(milli)转换为cfs quota
+func milliCPUToQuota(milliCPU int64) int64 {
+	quota := milliCPU * quotaPeriod / milliCPUToCPU
+	if quota < minQuotaPeriod {
+		return minQuotaPeriod
+	}
+	return quota
+}
+
+// containerOOMScoreAdj 按照pod的QoS类型计算oom_score_adj，
+// Burstable的容器内存requests占节点内存比例越高，越不容易被oom kill
+func containerOOMScoreAdj(container *v1.Container, pod *v1.Pod, memoryCapacity int64) int64 {
+	switch PodQOSClass(pod) {
+	case v1.PodQOSGuaranteed:
+		return guaranteedOOMScoreAdj
+	case v1.PodQOSBestEffort:
+		return besteffortOOMScoreAdj
+	}
+	if memoryCapacity <= 0 {
+		return besteffortOOMScoreAdj - 1
+	}
+	memoryRequest := container.Resources.Requests.Memory().Value()
+	adj := 1000 - (1000*memoryRequest)/memoryCapacity
+	// Burstable的值需要在(Guaranteed, BestEffort)之间
+	if adj < 1000+guaranteedOOMScoreAdj {
+		return 1000 + guaranteedOOMScoreAdj
+	}
+	if adj == besteffortOOMScoreAdj {
+		return besteffortOOMScoreAdj - 1
+	}
+	return adj
+}
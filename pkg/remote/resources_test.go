@@ -0,0 +1,109 @@
+package remote
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func resources(requests, limits map[v1.ResourceName]string) v1.ResourceRequirements {
+	r := v1.ResourceRequirements{Requests: v1.ResourceList{}, Limits: v1.ResourceList{}}
+	for name, value := range requests {
+		r.Requests[name] = resource.MustParse(value)
+	}
+	for name, value := range limits {
+		r.Limits[name] = resource.MustParse(value)
+	}
+	return r
+}
+
+func TestPodQOSClass(t *testing.T) {
+	guaranteed := resources(
+		map[v1.ResourceName]string{v1.ResourceCPU: "1", v1.ResourceMemory: "1Gi"},
+		map[v1.ResourceName]string{v1.ResourceCPU: "1", v1.ResourceMemory: "1Gi"})
+	burstable := resources(map[v1.ResourceName]string{v1.ResourceMemory: "1Gi"}, nil)
+	tests := []struct {
+		name           string
+		initContainers []v1.ResourceRequirements
+		containers     []v1.ResourceRequirements
+		want           v1.PodQOSClass
+	}{
+		{name: "best effort", containers: []v1.ResourceRequirements{{}}, want: v1.PodQOSBestEffort},
+		{name: "guaranteed", containers: []v1.ResourceRequirements{guaranteed, guaranteed}, want: v1.PodQOSGuaranteed},
+		{name: "burstable", containers: []v1.ResourceRequirements{burstable}, want: v1.PodQOSBurstable},
+		{name: "mixed", containers: []v1.ResourceRequirements{guaranteed, {}}, want: v1.PodQOSBurstable},
+		{
+			name:       "requests differ from limits",
+			containers: []v1.ResourceRequirements{resources(map[v1.ResourceName]string{v1.ResourceCPU: "500m", v1.ResourceMemory: "1Gi"}, map[v1.ResourceName]string{v1.ResourceCPU: "1", v1.ResourceMemory: "1Gi"})},
+			want:       v1.PodQOSBurstable,
+		},
+		{
+			name:           "init container counts",
+			initContainers: []v1.ResourceRequirements{burstable},
+			containers:     []v1.ResourceRequirements{guaranteed},
+			want:           v1.PodQOSBurstable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{}
+			for _, r := range tt.initContainers {
+				pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{Resources: r})
+			}
+			for _, r := range tt.containers {
+				pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: r})
+			}
+			if got := PodQOSClass(pod); got != tt.want {
+				t.Errorf("PodQOSClass() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerOOMScoreAdj(t *testing.T) {
+	const capacity = 4 << 30
+	guaranteed := resources(
+		map[v1.ResourceName]string{v1.ResourceCPU: "1", v1.ResourceMemory: "1Gi"},
+		map[v1.ResourceName]string{v1.ResourceCPU: "1", v1.ResourceMemory: "1Gi"})
+	tests := []struct {
+		name      string
+		resources v1.ResourceRequirements
+		capacity  int64
+		want      int64
+	}{
+		{name: "guaranteed", resources: guaranteed, capacity: capacity, want: guaranteedOOMScoreAdj},
+		{name: "best effort", resources: v1.ResourceRequirements{}, capacity: capacity, want: besteffortOOMScoreAdj},
+		{name: "burstable quarter of memory", resources: resources(map[v1.ResourceName]string{v1.ResourceMemory: "1Gi"}, nil), capacity: capacity, want: 750},
+		{name: "burstable whole memory", resources: resources(map[v1.ResourceName]string{v1.ResourceMemory: "4Gi"}, nil), capacity: capacity, want: 3},
+		{name: "burstable tiny request", resources: resources(map[v1.ResourceName]string{v1.ResourceMemory: "1"}, nil), capacity: capacity, want: 999},
+		{name: "unknown capacity", resources: resources(map[v1.ResourceName]string{v1.ResourceMemory: "1Gi"}, nil), capacity: 0, want: 999},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := v1.Container{Resources: tt.resources}
+			pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{container}}}
+			if got := containerOOMScoreAdj(&container, pod, tt.capacity); got != tt.want {
+				t.Errorf("containerOOMScoreAdj() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMilliCPUToShares(t *testing.T) {
+	tests := []struct {
+		milliCPU int64
+		want     int64
+	}{
+		{milliCPU: 0, want: minShares},
+		{milliCPU: 1, want: minShares},
+		{milliCPU: 500, want: 512},
+		{milliCPU: 1000, want: 1024},
+		{milliCPU: 2500, want: 2560},
+	}
+	for _, tt := range tests {
+		if got := milliCPUToShares(tt.milliCPU); got != tt.want {
+			t.Errorf("milliCPUToShares(%d) = %d, want %d", tt.milliCPU, got, tt.want)
+		}
+	}
+}
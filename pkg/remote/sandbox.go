@@ -2,6 +2,9 @@ package remote
 
 import (
 	"context"
+	"fmt"
+	"strings"
+
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	v1 "k8s.io/api/core/v1"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
@@ -53,10 +56,12 @@ func RemovePodSandbox(ctx context.Context, client criapi.RuntimeServiceClient, i
 	return nil
 }
 
-// GetPodSandboxes 获取PodSandboxes请求
-func GetPodSandboxes(ctx context.Context, client criapi.RuntimeServiceClient) ([]*criapi.PodSandbox, error) {
+// GetPodSandboxes 获取PodSandboxes请求，labelSelector为空时返回所有sandbox
+func GetPodSandboxes(ctx context.Context, client criapi.RuntimeServiceClient, labelSelector map[string]string) ([]*criapi.PodSandbox, error) {
 
-	filter := &criapi.PodSandboxFilter{}
+	filter := &criapi.PodSandboxFilter{
+		LabelSelector: labelSelector,
+	}
 	request := &criapi.ListPodSandboxRequest{
 		Filter: filter,
 	}
@@ -90,8 +95,32 @@ func GetPodSandboxStatus(ctx context.Context, client criapi.RuntimeServiceClient
 	return r.Status, nil
 }
 
-// GeneratePodSandboxConfig 从node给的pod配置生成CRI所需要的配置文件
-func GeneratePodSandboxConfig(ctx context.Context, pod *v1.Pod, logDir string, attempt uint32) (*criapi.PodSandboxConfig, error) {
+// PortForward 准备转发pod sandbox端口的流式请求，返回streaming server的url。
+// 要转发的端口由客户端在建立的每个stream中指定
+func PortForward(ctx context.Context, client criapi.RuntimeServiceClient, psId string) (string, error) {
+
+	if psId == "" {
+		err := errdefs.InvalidInput("Pod ID cannot be empty")
+		return "", err
+	}
+	request := &criapi.PortForwardRequest{
+		PodSandboxId: psId,
+	}
+
+	r, err := client.PortForward(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return r.Url, nil
+}
+
+// GeneratePodSandboxConfig 从node给的pod配置生成CRI所需要的配置文件，nodeName写入sandbox的标签，
+// dnsConfig由provider按照dnsPolicy生成，clusterDomain用于生成subdomain的域名
+func GeneratePodSandboxConfig(ctx context.Context, pod *v1.Pod, nodeName string, logDir string, attempt uint32, dnsConfig *criapi.DNSConfig, clusterDomain string) (*criapi.PodSandboxConfig, error) {
+	hostname, _, err := PodHostnameAndDomain(pod, clusterDomain)
+	if err != nil {
+		return nil, err
+	}
 	podUID := string(pod.UID)
 	config := &criapi.PodSandboxConfig{
 		Metadata: &criapi.PodSandboxMetadata{
@@ -100,13 +129,150 @@ func GeneratePodSandboxConfig(ctx context.Context, pod *v1.Pod, logDir string, a
 			Uid:       podUID,
 			Attempt:   attempt,
 		},
-		//Labels:       createPodLabels(pod),
+		Labels:       createPodLabels(pod, nodeName),
 		Annotations:  pod.Annotations,
 		LogDirectory: logDir,
-		//DnsConfig:    createPodDnsConfig(pod),
-		//Hostname:     createPodHostname(pod),
-		//PortMappings: createPortMappings(pod),
-		//Linux:        createPodSandboxLinuxConfig(pod),
+		DnsConfig:    dnsConfig,
+		Hostname:     hostname,
+		PortMappings: createPortMappings(pod),
+	}
+	linux, err := createPodSandboxLinuxConfig(pod)
+	if err != nil {
+		return nil, err
 	}
+	config.Linux = linux
 	return config, nil
 }
+
+// createPodSandboxLinuxConfig 由pod的securityContext生成sandbox的linux配置
+func createPodSandboxLinuxConfig(pod *v1.Pod) (*criapi.LinuxPodSandboxConfig, error) {
+	seccomp, err := PodSeccompProfile(pod)
+	if err != nil {
+		return nil, err
+	}
+	sc := &criapi.LinuxSandboxSecurityContext{
+		NamespaceOptions: createPodNamespaceOptions(pod),
+		Seccomp:          seccomp,
+	}
+	config := &criapi.LinuxPodSandboxConfig{
+		SecurityContext: sc,
+		Sysctls:         map[string]string{},
+	}
+
+	// 任意一个容器为特权容器时，sandbox也需要为特权模式
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged {
+				sc.Privileged = true
+			}
+		}
+	}
+
+	psc := pod.Spec.SecurityContext
+	if psc == nil {
+		return config, nil
+	}
+	sc.RunAsUser = int64Value(psc.RunAsUser)
+	sc.RunAsGroup = int64Value(psc.RunAsGroup)
+	sc.SelinuxOptions = convertSELinuxOptions(psc.SELinuxOptions)
+	// 与kubelet一致，fsGroup作为附加组，volume的属组由provider在准备volume时修改
+	if psc.FSGroup != nil {
+		sc.SupplementalGroups = append(sc.SupplementalGroups, *psc.FSGroup)
+	}
+	sc.SupplementalGroups = append(sc.SupplementalGroups, psc.SupplementalGroups...)
+	for _, sysctl := range psc.Sysctls {
+		config.Sysctls[sysctl.Name] = sysctl.Value
+	}
+	return config, nil
+}
+
+// createPodNamespaceOptions 由hostNetwork、hostPID、hostIPC与shareProcessNamespace生成namespace配置
+func createPodNamespaceOptions(pod *v1.Pod) *criapi.NamespaceOption {
+	opts := &criapi.NamespaceOption{
+		Network: criapi.NamespaceMode_POD,
+		Pid:     criapi.NamespaceMode_CONTAINER,
+		Ipc:     criapi.NamespaceMode_POD,
+	}
+	if pod.Spec.HostNetwork {
+		opts.Network = criapi.NamespaceMode_NODE
+	}
+	if pod.Spec.HostIPC {
+		opts.Ipc = criapi.NamespaceMode_NODE
+	}
+	switch {
+	case pod.Spec.HostPID:
+		opts.Pid = criapi.NamespaceMode_NODE
+	case pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace:
+		opts.Pid = criapi.NamespaceMode_POD
+	}
+	return opts
+}
+
+// PodHostnameAndDomain 与kubelet一致，生成pod的主机名与域名：
+// 主机名默认为pod名称，超过63个字符时截断；设置了subdomain时域名为<subdomain>.<namespace>.svc.<clusterDomain>；
+// setHostnameAsFQDN为true时主机名为完整域名
+func PodHostnameAndDomain(pod *v1.Pod, clusterDomain string) (string, string, error) {
+	hostname := pod.Name
+	if pod.Spec.Hostname != "" {
+		hostname = pod.Spec.Hostname
+	}
+	hostname, err := truncateHostname(hostname)
+	if err != nil {
+		return "", "", err
+	}
+
+	var domain string
+	if pod.Spec.Subdomain != "" {
+		domain = fmt.Sprintf("%s.%s.svc.%s", pod.Spec.Subdomain, pod.Namespace, clusterDomain)
+	}
+
+	if pod.Spec.SetHostnameAsFQDN != nil && *pod.Spec.SetHostnameAsFQDN && domain != "" {
+		fqdn := fmt.Sprintf("%s.%s", hostname, domain)
+		// linux内核限制主机名最长64个字符
+		if len(fqdn) > 64 {
+			return "", "", errdefs.InvalidInputf("failed to construct FQDN from pod hostname and cluster domain, FQDN %s is too long (64 characters is the max, %d characters requested)", fqdn, len(fqdn))
+		}
+		hostname = fqdn
+	}
+	return hostname, domain, nil
+}
+
+// truncateHostname 主机名最长63个字符，截断后去掉末尾的'-'与'.'
+func truncateHostname(hostname string) (string, error) {
+	const hostnameMaxLen = 63
+	if len(hostname) <= hostnameMaxLen {
+		return hostname, nil
+	}
+	truncated := strings.TrimRight(hostname[:hostnameMaxLen], "-.")
+	if len(truncated) == 0 {
+		return "", errdefs.InvalidInputf("hostname %q can not be used", hostname)
+	}
+	return truncated, nil
+}
+
+// createPortMappings 由容器的ports生成端口映射，hostPort不为0的端口会暴露到宿主机上
+func createPortMappings(pod *v1.Pod) []*criapi.PortMapping {
+	var mappings []*criapi.PortMapping
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			mappings = append(mappings, &criapi.PortMapping{
+				Protocol:      convertProtocol(p.Protocol),
+				ContainerPort: p.ContainerPort,
+				HostPort:      p.HostPort,
+				HostIp:        p.HostIP,
+			})
+		}
+	}
+	return mappings
+}
+
+// convertProtocol 转换端口协议，默认为TCP
+func convertProtocol(protocol v1.Protocol) criapi.Protocol {
+	switch protocol {
+	case v1.ProtocolUDP:
+		return criapi.Protocol_UDP
+	case v1.ProtocolSCTP:
+		return criapi.Protocol_SCTP
+	}
+	return criapi.Protocol_TCP
+}
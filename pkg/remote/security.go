@@ -0,0 +1,203 @@
+package remote
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// SeccompProfileRoot Localhost类型seccomp配置文件所在的目录，与kubelet默认值一致
+const SeccompProfileRoot = "/var/lib/kubelet/seccomp"
+
+// PodSeccompProfile 获取pod级别的seccomp配置，securityContext优先于annotation，都没有设置时为Unconfined
+func PodSeccompProfile(pod *v1.Pod) (*criapi.SecurityProfile, error) {
+	var profile *v1.SeccompProfile
+	if pod.Spec.SecurityContext != nil {
+		profile = pod.Spec.SecurityContext.SeccompProfile
+	}
+	return convertSeccompProfile(profile, pod.Annotations[v1.SeccompPodAnnotationKey])
+}
+
+// convertSeccompProfile 转换seccomp配置，annotation为已废弃的写法，例如runtime/default、localhost/<path>
+func convertSeccompProfile(profile *v1.SeccompProfile, annotation string) (*criapi.SecurityProfile, error) {
+	if profile != nil {
+		switch profile.Type {
+		case v1.SeccompProfileTypeRuntimeDefault:
+			return &criapi.SecurityProfile{ProfileType: criapi.SecurityProfile_RuntimeDefault}, nil
+		case v1.SeccompProfileTypeUnconfined:
+			return &criapi.SecurityProfile{ProfileType: criapi.SecurityProfile_Unconfined}, nil
+		case v1.SeccompProfileTypeLocalhost:
+			if profile.LocalhostProfile == nil {
+				return nil, errdefs.InvalidInput("localhostProfile must be set for Localhost seccomp profile")
+			}
+			return localhostSeccompProfile(*profile.LocalhostProfile)
+		}
+		return nil, errdefs.InvalidInputf("unsupported seccomp profile type %s", profile.Type)
+	}
+
+	switch {
+	case annotation == "" || annotation == v1.SeccompProfileNameUnconfined:
+		return &criapi.SecurityProfile{ProfileType: criapi.SecurityProfile_Unconfined}, nil
+	case annotation == v1.SeccompProfileRuntimeDefault || annotation == v1.DeprecatedSeccompProfileDockerDefault:
+		return &criapi.SecurityProfile{ProfileType: criapi.SecurityProfile_RuntimeDefault}, nil
+	case strings.HasPrefix(annotation, v1.SeccompLocalhostProfileNamePrefix):
+		return localhostSeccompProfile(strings.TrimPrefix(annotation, v1.SeccompLocalhostProfileNamePrefix))
+	}
+	return nil, errdefs.InvalidInputf("unsupported seccomp profile %q", annotation)
+}
+
+// localhostSeccompProfile Localhost类型的配置文件为SeccompProfileRoot下的相对路径
+func localhostSeccompProfile(path string) (*criapi.SecurityProfile, error) {
+	if path == "" || filepath.IsAbs(path) || strings.Contains(path, "..") {
+		return nil, errdefs.InvalidInputf("invalid localhost seccomp profile %q", path)
+	}
+	return &criapi.SecurityProfile{
+		ProfileType:  criapi.SecurityProfile_Localhost,
+		LocalhostRef: filepath.Join(SeccompProfileRoot, path),
+	}, nil
+}
+
+// convertSELinuxOptions 转换SELinux配置
+func convertSELinuxOptions(opts *v1.SELinuxOptions) *criapi.SELinuxOption {
+	if opts == nil {
+		return nil
+	}
+	return &criapi.SELinuxOption{
+		User:  opts.User,
+		Role:  opts.Role,
+		Type:  opts.Type,
+		Level: opts.Level,
+	}
+}
+
+// int64Value 转换为CRI中的可选int64
+func int64Value(v *int64) *criapi.Int64Value {
+	if v == nil {
+		return nil
+	}
+	return &criapi.Int64Value{Value: *v}
+}
+
+// defaultMaskedPaths 非特权容器中需要屏蔽的路径，与kubelet一致
+var defaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+// defaultReadonlyPaths 非特权容器中需要只读的路径，与kubelet一致
+var defaultReadonlyPaths = []string{
+	"/proc/asound",
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// EffectiveRunAsUser 容器实际使用的uid，容器的securityContext优先于pod
+func EffectiveRunAsUser(container *v1.Container, pod *v1.Pod) *int64 {
+	if container.SecurityContext != nil && container.SecurityContext.RunAsUser != nil {
+		return container.SecurityContext.RunAsUser
+	}
+	if pod.Spec.SecurityContext != nil {
+		return pod.Spec.SecurityContext.RunAsUser
+	}
+	return nil
+}
+
+// EffectiveRunAsNonRoot 容器是否要求以非root用户运行，容器的securityContext优先于pod
+func EffectiveRunAsNonRoot(container *v1.Container, pod *v1.Pod) bool {
+	if container.SecurityContext != nil && container.SecurityContext.RunAsNonRoot != nil {
+		return *container.SecurityContext.RunAsNonRoot
+	}
+	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.RunAsNonRoot != nil {
+		return *pod.Spec.SecurityContext.RunAsNonRoot
+	}
+	return false
+}
+
+// containerSeccompProfile 获取容器的seccomp配置，依次使用容器的securityContext、容器的annotation与pod级别的配置
+func containerSeccompProfile(container *v1.Container, pod *v1.Pod) (*criapi.SecurityProfile, error) {
+	if container.SecurityContext != nil && container.SecurityContext.SeccompProfile != nil {
+		return convertSeccompProfile(container.SecurityContext.SeccompProfile, "")
+	}
+	if annotation, ok := pod.Annotations[v1.SeccompContainerAnnotationKeyPrefix+container.Name]; ok {
+		return convertSeccompProfile(nil, annotation)
+	}
+	return PodSeccompProfile(pod)
+}
+
+// createCtrSecurityContext 合并pod与容器的securityContext，生成CRI需要的容器安全配置
+func createCtrSecurityContext(container *v1.Container, pod *v1.Pod) (*criapi.LinuxContainerSecurityContext, error) {
+	seccomp, err := containerSeccompProfile(container, pod)
+	if err != nil {
+		return nil, err
+	}
+	sc := &criapi.LinuxContainerSecurityContext{
+		NamespaceOptions: createPodNamespaceOptions(pod),
+		RunAsUser:        int64Value(EffectiveRunAsUser(container, pod)),
+		Seccomp:          seccomp,
+	}
+
+	if psc := pod.Spec.SecurityContext; psc != nil {
+		sc.RunAsGroup = int64Value(psc.RunAsGroup)
+		sc.SelinuxOptions = convertSELinuxOptions(psc.SELinuxOptions)
+		if psc.FSGroup != nil {
+			sc.SupplementalGroups = append(sc.SupplementalGroups, *psc.FSGroup)
+		}
+		sc.SupplementalGroups = append(sc.SupplementalGroups, psc.SupplementalGroups...)
+	}
+
+	csc := container.SecurityContext
+	if csc != nil {
+		if csc.RunAsGroup != nil {
+			sc.RunAsGroup = int64Value(csc.RunAsGroup)
+		}
+		if csc.SELinuxOptions != nil {
+			sc.SelinuxOptions = convertSELinuxOptions(csc.SELinuxOptions)
+		}
+		if csc.Privileged != nil {
+			sc.Privileged = *csc.Privileged
+		}
+		if csc.ReadOnlyRootFilesystem != nil {
+			sc.ReadonlyRootfs = *csc.ReadOnlyRootFilesystem
+		}
+		if csc.Capabilities != nil {
+			sc.Capabilities = &criapi.Capability{
+				AddCapabilities:  capabilityNames(csc.Capabilities.Add),
+				DropCapabilities: capabilityNames(csc.Capabilities.Drop),
+			}
+		}
+		// 没有设置allowPrivilegeEscalation时允许提权，与kubelet一致
+		if csc.AllowPrivilegeEscalation != nil {
+			sc.NoNewPrivs = !*csc.AllowPrivilegeEscalation
+		}
+	}
+
+	// 特权容器不屏蔽任何路径，procMount为Unmasked时也不屏蔽
+	// 复制默认路径，避免多个容器的配置共用同一个slice
+	if !sc.Privileged && (csc == nil || csc.ProcMount == nil || *csc.ProcMount != v1.UnmaskedProcMount) {
+		sc.MaskedPaths = append([]string(nil), defaultMaskedPaths...)
+		sc.ReadonlyPaths = append([]string(nil), defaultReadonlyPaths...)
+	}
+	return sc, nil
+}
+
+// capabilityNames 转换capabilities名称
+func capabilityNames(caps []v1.Capability) []string {
+	names := make([]string, 0, len(caps))
+	for _, c := range caps {
+		names = append(names, string(c))
+	}
+	return names
+}
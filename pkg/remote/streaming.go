@@ -0,0 +1,114 @@
+package remote
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// StreamURL 连接CRI streaming server返回的exec url，并转发标准输入输出。
+// 命令退出码不为0时，返回的错误实现了 k8s.io/utils/exec.ExitError
+func StreamURL(rawURL string, opts remotecommand.StreamOptions) error {
+	u, err := parseStreamingURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	// containerd的streaming server默认只监听本地地址
+	config := &rest.Config{
+		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+	}
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, u)
+	if err != nil {
+		return err
+	}
+	return executor.Stream(opts)
+}
+
+// ProxyStream 把客户端的升级请求(attach/portForward)原样转发给CRI streaming server返回的url，
+// 与kubelet不开启重定向时相同，之后在两个连接之间双向复制数据直到任意一端关闭。
+// 返回错误时还没有接管连接，调用方可以继续写入http响应
+func ProxyStream(w http.ResponseWriter, req *http.Request, rawURL string) error {
+	if !httpstream.IsUpgradeRequest(req) {
+		return errdefs.InvalidInput("streaming request must upgrade the connection")
+	}
+	u, err := parseStreamingURL(rawURL)
+	if err != nil {
+		return err
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("response writer does not support connection hijacking")
+	}
+
+	backend, err := dialStreamingServer(u)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	// 请求中的参数已经由streaming server根据url中的token缓存，只需替换请求地址
+	upstream := req.Clone(req.Context())
+	upstream.URL = u
+	upstream.Host = u.Host
+	upstream.RequestURI = ""
+	if err = upstream.Write(backend); err != nil {
+		return err
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// 连接已经被接管，之后无法再向客户端返回错误
+	done := make(chan struct{}, 2)
+	go func() {
+		// buf中可能还有客户端已经发送、尚未读取的数据
+		io.Copy(backend, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	// 任意一个方向结束后关闭两个连接，另一个方向的复制随之退出
+	<-done
+	return nil
+}
+
+// dialStreamingServer 连接streaming server，https时与StreamURL相同不校验证书
+func dialStreamingServer(u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "https" {
+		return tls.Dial("tcp", host, &tls.Config{InsecureSkipVerify: true})
+	}
+	return net.Dial("tcp", host)
+}
+
+func parseStreamingURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid streaming url %q", rawURL)
+	}
+	return u, nil
+}
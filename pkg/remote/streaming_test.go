@@ -0,0 +1,71 @@
+package remote
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyStream(t *testing.T) {
+	// backend模拟CRI streaming server：升级连接后原样返回收到的数据
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/attach/token" {
+			http.Error(w, "unexpected path "+req.URL.Path, http.StatusNotFound)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+		io.Copy(conn, buf)
+	}))
+	defer backend.Close()
+
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := ProxyStream(w, req, backend.URL+"/attach/token"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer front.Close()
+
+	t.Run("upgrade", func(t *testing.T) {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "POST /attach/ns/pod/c HTTP/1.1\r\nHost: vk\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\nping")
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "ping" {
+			t.Errorf("echo = %q, want %q", got, "ping")
+		}
+	})
+
+	t.Run("no upgrade", func(t *testing.T) {
+		resp, err := http.Post(front.URL+"/attach/ns/pod/c", "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+}